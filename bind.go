@@ -0,0 +1,219 @@
+package jsapi
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// EvalAs executes javascript source and returns the result scanned into a T.
+//
+//	n, err := jsapi.EvalAs[int](cx, `1+1`)
+func EvalAs[T any](ev Evaluator, source string) (T, error) {
+	var result T
+	err := ev.Eval(source, &result)
+	return result, err
+}
+
+// Func returns a Go func of type F that calls the javascript function at
+// path when invoked. Arguments and the return value are converted as they
+// would be for Call.
+//
+//	add, err := jsapi.Func[func(int, int) (int, error)](cx, "math.add")
+//
+// F may return nothing, a value, an error or a value and an error. If F
+// does not return an error then errors raised by the javascript will panic.
+func Func[F any](c Caller, path string) (F, error) {
+	var fn F
+	t := reflect.TypeOf(&fn).Elem()
+	if t.Kind() != reflect.Func {
+		return fn, fmt.Errorf("Func requires a func type but got %s", t)
+	}
+	var ok bool
+	if err := c.Eval(fmt.Sprintf("typeof %s === 'function'", path), &ok); err != nil {
+		return fn, err
+	}
+	if !ok {
+		return fn, fmt.Errorf("%s is not a function", path)
+	}
+	v, err := bindFunc(c, path, t)
+	if err != nil {
+		return fn, err
+	}
+	reflect.ValueOf(&fn).Elem().Set(v)
+	return fn, nil
+}
+
+// Bind returns a T whose exported func fields call the methods of the
+// javascript object at path. T must be a struct (or pointer to a struct),
+// fields are bound to the method of the same camelCased name or to the name
+// given by a `js:"name"` field tag.
+//
+//	type jsGreeter struct { GreetFunc func(string) (string, error) `js:"greet"` }
+//
+//	g, err := jsapi.Bind[jsGreeter](cx, "greeter")
+//
+// T cannot be an interface type, Go cannot construct implementations of an
+// interface at runtime. A struct of funcs with methods that forward to them
+// can be used where an interface is wanted, see Context.Implement.
+func Bind[T any](c Caller, path string) (T, error) {
+	var obj T
+	v := reflect.ValueOf(&obj).Elem()
+	if v.Kind() == reflect.Ptr {
+		v.Set(reflect.New(v.Type().Elem()))
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return obj, fmt.Errorf("Bind requires a struct type but got %s", v.Type())
+	}
+	err := bindStruct(c, path, v, nil)
+	return obj, err
+}
+
+// implement fills v, a pointer to a struct of funcs or to an interface
+// implemented by the struct of funcs impl, with funcs that call the methods
+// of the javascript object at path.
+func implement(c Caller, v interface{}, path string, impl interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("Implement requires a non-nil pointer but got %T", v)
+	}
+	target := rv.Elem()
+	switch target.Kind() {
+	case reflect.Struct:
+		return bindStruct(c, path, target, nil)
+	case reflect.Interface:
+		it := target.Type()
+		st := reflect.TypeOf(impl)
+		if st != nil && st.Kind() == reflect.Ptr {
+			st = st.Elem()
+		}
+		if st == nil || st.Kind() != reflect.Struct {
+			return fmt.Errorf("implementation of %s must be a struct but got %T", it, impl)
+		}
+		if !st.Implements(it) && !reflect.PtrTo(st).Implements(it) {
+			return fmt.Errorf("%s does not implement %s", st, it)
+		}
+		obj := reflect.New(st)
+		if err := bindStruct(c, path, obj.Elem(), it); err != nil {
+			return err
+		}
+		if st.Implements(it) {
+			target.Set(obj.Elem())
+		} else {
+			target.Set(obj)
+		}
+		return nil
+	}
+	return fmt.Errorf("Implement requires a pointer to a struct or interface but got %T", v)
+}
+
+// bindStruct binds the func fields of the struct v to methods of the
+// javascript object at path after checking they all exist. When it is
+// the interface being implemented, an untagged field XFunc is named after
+// the method X it forwards to.
+func bindStruct(c Caller, path string, v reflect.Value, it reflect.Type) error {
+	t := v.Type()
+	var names []string
+	var fields []int
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Type.Kind() != reflect.Func {
+			continue
+		}
+		name := f.Tag.Get("js")
+		if name == "" {
+			name = jsName(methodName(it, f.Name))
+		}
+		names = append(names, name)
+		fields = append(fields, i)
+	}
+	var missing []string
+	err := c.Eval(fmt.Sprintf(
+		"(function(o, names){ return names.filter(function(n){ return typeof o[n] !== 'function' }) })(%s, %s)",
+		path, quoteNames(names)), &missing)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s is missing methods: %s", path, strings.Join(missing, ", "))
+	}
+	for i, name := range names {
+		fn, err := bindFunc(c, path+"."+name, t.Field(fields[i]).Type)
+		if err != nil {
+			return fmt.Errorf("%s: %s", t.Field(fields[i]).Name, err.Error())
+		}
+		v.Field(fields[i]).Set(fn)
+	}
+	return nil
+}
+
+// methodName is the method of the interface it that the field name
+// forwards to, or name itself when there is no such method
+func methodName(it reflect.Type, name string) string {
+	if it == nil || !strings.HasSuffix(name, "Func") {
+		return name
+	}
+	if m, ok := it.MethodByName(strings.TrimSuffix(name, "Func")); ok {
+		return m.Name
+	}
+	return name
+}
+
+// bindFunc makes a func of type t that calls the javascript function at path
+func bindFunc(c Caller, path string, t reflect.Type) (reflect.Value, error) {
+	nout := t.NumOut()
+	hasErr := nout > 0 && t.Out(nout-1) == errorType
+	nresults := nout
+	if hasErr {
+		nresults--
+	}
+	if nresults > 1 {
+		return reflect.Value{}, fmt.Errorf("javascript does not support multiple return params")
+	}
+	return reflect.MakeFunc(t, func(in []reflect.Value) []reflect.Value {
+		args := make([]interface{}, 0, len(in))
+		for i, v := range in {
+			if t.IsVariadic() && i == len(in)-1 {
+				for j := 0; j < v.Len(); j++ {
+					args = append(args, v.Index(j).Interface())
+				}
+				continue
+			}
+			args = append(args, v.Interface())
+		}
+		var result reflect.Value
+		var ptr interface{}
+		if nresults == 1 {
+			result = reflect.New(t.Out(0))
+			ptr = result.Interface()
+		}
+		err := c.Call(path, ptr, args...)
+		if err != nil && !hasErr {
+			panic(err)
+		}
+		out := make([]reflect.Value, 0, nout)
+		if nresults == 1 {
+			out = append(out, result.Elem())
+		}
+		if hasErr {
+			errv := reflect.Zero(errorType)
+			if err != nil {
+				errv = reflect.ValueOf(&err).Elem()
+			}
+			out = append(out, errv)
+		}
+		return out
+	}), nil
+}
+
+// quoteNames returns a javascript array literal of names
+func quoteNames(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = fmt.Sprintf("%q", name)
+	}
+	return "[" + strings.Join(quoted, ",") + "]"
+}
@@ -0,0 +1,203 @@
+package jsapi
+
+import (
+	"testing"
+)
+
+func TestCall(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	err := cx.Exec(`var math = { n: 10, add: function(a, b){ return this.n + a + b } }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var i int
+	err = cx.Call("math.add", &i, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 13 {
+		t.Fatalf("expected math.add(1,2) called with math as this to return 13 but got %d", i)
+	}
+
+}
+
+func TestEvalAs(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	s, err := EvalAs[string](cx, `"h"+"ello"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "hello" {
+		t.Fatalf("expected to eval to the string \"hello\" got %s", s)
+	}
+
+}
+
+func TestFunc(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	err := cx.Exec(`
+		var strs = {
+			repeat: function(s, n){ return new Array(n + 1).join(s) },
+			fail: function(){ throw new Error('nope') }
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repeat, err := Func[func(string, int) (string, error)](cx, "strs.repeat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := repeat("ab", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "ababab" {
+		t.Fatalf(`expected repeat("ab", 3) to return "ababab" but got %q`, s)
+	}
+
+	fail, err := Func[func() error](cx, "strs.fail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fail()
+	r, ok := err.(*ErrorReport)
+	if !ok {
+		t.Fatalf("expected the error to be an ErrorReport but got: %T %v", err, err)
+	}
+	if r.Message != "Error: nope" {
+		t.Fatalf(`expected error message to be "Error: nope" but got %q`, r.Message)
+	}
+
+	_, err = Func[func()](cx, "strs.missing")
+	if err == nil {
+		t.Fatalf("expected an error binding a function that doesn't exist")
+	}
+
+}
+
+type greeter interface {
+	Greet(name string) (string, error)
+}
+
+type jsGreeter struct {
+	GreetFunc func(string) (string, error) `js:"greet"`
+	Count     func() int
+}
+
+func (g jsGreeter) Greet(name string) (string, error) {
+	return g.GreetFunc(name)
+}
+
+func TestBind(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	err := cx.Exec(`
+		var greeter = {
+			n: 0,
+			greet: function(name){ this.n++; return 'hello ' + name },
+			count: function(){ return this.n }
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := Bind[jsGreeter](cx, "greeter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var _ greeter = g
+	s, err := g.Greet("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "hello bob" {
+		t.Fatalf(`expected Greet("bob") to return "hello bob" but got %q`, s)
+	}
+	if n := g.Count(); n != 1 {
+		t.Fatalf("expected Count() to return 1 but got %d", n)
+	}
+
+	err = cx.Exec(`var broken = { greet: 1 }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Bind[*jsGreeter](cx, "broken")
+	if err == nil {
+		t.Fatalf("expected an error binding an object without the methods")
+	}
+	if _, err := Bind[greeter](cx, "greeter"); err == nil {
+		t.Fatalf("expected an error binding an interface type")
+	}
+
+}
+
+type doc struct {
+	Title string
+}
+
+type validator interface {
+	Validate(d doc) error
+}
+
+type jsValidator struct {
+	ValidateFunc func(doc) error
+}
+
+func (v *jsValidator) Validate(d doc) error {
+	return v.ValidateFunc(d)
+}
+
+func TestImplement(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	err := cx.Exec(`
+		var plugins = {
+			myValidator: {
+				validate: function(d){ if( !d.Title ){ throw new Error('title required') } }
+			}
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var v validator
+	err = cx.Implement(&v, "plugins.myValidator", jsValidator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Validate(doc{"ok"}); err != nil {
+		t.Fatal(err)
+	}
+	err = v.Validate(doc{})
+	r, ok := err.(*ErrorReport)
+	if !ok {
+		t.Fatalf("expected the error to be an ErrorReport but got: %T %v", err, err)
+	}
+	if r.Message != "Error: title required" {
+		t.Fatalf(`expected error message to be "Error: title required" but got %q`, r.Message)
+	}
+
+	var g greeter
+	if err := cx.Implement(&g, "plugins.myValidator", jsValidator{}); err == nil {
+		t.Fatalf("expected an error implementing an interface with the wrong type")
+	}
+
+}
@@ -0,0 +1,57 @@
+package jsapi
+
+import (
+	"errors"
+)
+
+// ErrBudgetExceeded is returned when an evaluation uses up its Budget.
+var ErrBudgetExceeded = errors.New("execution budget exceeded")
+
+// ErrInterrupted is returned by an evaluation stopped by Interrupt.
+var ErrInterrupted = errors.New("evaluation interrupted")
+
+// Budget limits the work an evaluation may do. Unlike a timeout it is
+// deterministic, the same script uses the same budget however busy the
+// machine is.
+type Budget struct {
+	// Operations counts loop iterations and function calls made by
+	// javascript. Zero means no limit, the operations are only counted.
+	Operations int64
+}
+
+// budget tracks the consumption of a Budget on the worker thread. Nested
+// budgets also count against their parents.
+type budget struct {
+	limit  int64
+	used   int64
+	parent *budget
+}
+
+// tick counts an operation, it returns false if any budget is used up
+func (b *budget) tick() bool {
+	ok := true
+	for ; b != nil; b = b.parent {
+		if b.limit > 0 && b.used >= b.limit {
+			ok = false
+			continue
+		}
+		b.used++
+	}
+	return ok
+}
+
+// EvalWithBudget is like Eval but fails with ErrBudgetExceeded if the
+// script exceeds b. The amount of the budget consumed is returned either
+// way, so that it can be accounted for. Evaluations made by Go functions
+// called from the script count towards the budget.
+func (cx *Context) EvalWithBudget(source string, result interface{}, b Budget) (used Budget, err error) {
+	bgt := &budget{limit: b.Operations}
+	// Raw results want plain JSON rather than tagged Dates/Maps/Sets
+	_, raw := result.(*Raw)
+	data, err := cx.evalJSON(nil, bgt, source, !raw)
+	used = Budget{Operations: bgt.used}
+	if err != nil {
+		return used, err
+	}
+	return used, cx.codec.unmarshal(data, result)
+}
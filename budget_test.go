@@ -0,0 +1,78 @@
+package jsapi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEvalWithBudget(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	var i int
+	used, err := cx.EvalWithBudget(`var n = 0; for( var i = 0; i < 100; i++ ){ n++ }; n`, &i, Budget{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 100 {
+		t.Fatalf("expected loop to count to 100 but got %d", i)
+	}
+	if used.Operations < 100 {
+		t.Fatalf("expected at least 100 operations to be counted but got %d", used.Operations)
+	}
+
+	// the same script always costs the same
+	again, err := cx.EvalWithBudget(`var n = 0; for( var i = 0; i < 100; i++ ){ n++ }; n`, &i, Budget{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != used {
+		t.Fatalf("expected the same cost each time but got %d then %d", used.Operations, again.Operations)
+	}
+
+	used, err = cx.EvalWithBudget(`while( true ){}`, &i, Budget{Operations: 1000})
+	if err != ErrBudgetExceeded {
+		t.Fatalf("expected ErrBudgetExceeded but got %v", err)
+	}
+	if used.Operations != 1000 {
+		t.Fatalf("expected the whole budget to be consumed but got %d", used.Operations)
+	}
+
+	// the context is still usable
+	if err := cx.Eval(`1+1`, &i); err != nil || i != 2 {
+		t.Fatalf("expected to eval after exceeding the budget but got %v", err)
+	}
+
+}
+
+func TestInterrupt(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	if cx.Interrupt() {
+		t.Fatalf("expected Interrupt to report nothing running")
+	}
+
+	started := make(chan bool)
+	cx.DefineFunction("started", func() { close(started) })
+	errs := make(chan error, 1)
+	go func() {
+		errs <- cx.Exec(`started(); while( true ){}`)
+	}()
+	<-started
+	for !cx.Interrupt() {
+		time.Sleep(time.Millisecond)
+	}
+	if err := <-errs; err != ErrInterrupted {
+		t.Fatalf("expected ErrInterrupted but got %v", err)
+	}
+
+	// later calls are unaffected
+	var i int
+	if err := cx.Eval(`1+1`, &i); err != nil || i != 2 {
+		t.Fatalf("expected to eval after an interrupt but got %v", err)
+	}
+
+}
@@ -8,5 +8,6 @@ void Init(){
 	go_setter = setprop;
 	go_worker_wait = workerWait;
 	go_worker_fail = workerFail;
+	go_interrupt = interrupt;
 }
 
@@ -0,0 +1,1205 @@
+package jsapi
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Values that have no native JSON representation (Date, Map and Set) are
+// passed between javascript and Go as tagged objects of the form:
+//
+//	{"__jsapi__": "Date", "value": 1325376000000}
+//	{"__jsapi__": "Map", "value": [[k1, v1], [k2, v2]]}
+//	{"__jsapi__": "Set", "value": [v1, v2]}
+//
+// The javascript side of this is the replacer/reviver pair installed
+// into every context by lib/js.cpp.
+//
+// So that user objects can't be mistaken for tagged values, keys made of
+// underscores followed by the tag key are escaped with one more leading
+// underscore on the way across and unescaped on arrival, eg. a user key
+// "__jsapi__" is sent as "___jsapi__".
+const tagKey = "__jsapi__"
+
+// escapeKey escapes an object key that could be mistaken for tagKey
+func escapeKey(k string) string {
+	if strings.HasSuffix(k, tagKey) && strings.Trim(k[:len(k)-len(tagKey)], "_") == "" {
+		return "_" + k
+	}
+	return k
+}
+
+// unescapeKey reverses escapeKey
+func unescapeKey(k string) string {
+	if k != tagKey && strings.HasSuffix(k, tagKey) && strings.Trim(k[:len(k)-len(tagKey)], "_") == "" {
+		return k[1:]
+	}
+	return k
+}
+
+// parseKey is the global holding a JSON.parse bound to the reviver, it
+// keeps working when the JSON global has been removed or replaced
+const parseKey = "__jsapi_parse__"
+
+// jsMap is the decoded form of a javascript Map, entries keep their
+// insertion order and keys of any type.
+type jsMap [][2]interface{}
+
+// jsSet is the decoded form of a javascript Set.
+type jsSet []interface{}
+
+// JSMarshaler is the interface implemented by types that can convert
+// themselves into a javascript value. The returned value is converted
+// as normal, so it may be any Go value that could otherwise be passed
+// to javascript (strings, numbers, maps, slices, time.Time etc).
+type JSMarshaler interface {
+	MarshalJS() (interface{}, error)
+}
+
+// JSUnmarshaler is the interface implemented by types that can fill
+// themselves from a javascript value. The value given will be one of
+// nil, bool, float64, string, time.Time, []interface{},
+// map[string]interface{} or map[interface{}]interface{}.
+type JSUnmarshaler interface {
+	UnmarshalJS(v interface{}) error
+}
+
+var (
+	rawType           = reflect.TypeOf(Raw(""))
+	timeType          = reflect.TypeOf(time.Time{})
+	emptyStructType   = reflect.TypeOf(struct{}{})
+	marshalerType     = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	unmarshalerType   = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	jsMarshalerType   = reflect.TypeOf((*JSMarshaler)(nil)).Elem()
+	jsUnmarshalerType = reflect.TypeOf((*JSUnmarshaler)(nil)).Elem()
+)
+
+// converter is a pair of functions registered via RegisterConverter
+type converter struct {
+	to   func(interface{}) (interface{}, error)
+	from func(interface{}) (interface{}, error)
+}
+
+// codec converts values between Go and the JSON passed to/from javascript
+// consulting any registered converters on the way.
+type codec struct {
+	mu         sync.RWMutex
+	converters map[reflect.Type]*converter
+	strict     bool // reject lossy number conversions
+	maps       bool // encode Go maps as Map and Set, see SetNativeMaps
+}
+
+func newCodec() *codec {
+	return &codec{
+		converters: make(map[reflect.Type]*converter),
+	}
+}
+
+func (c *codec) register(t reflect.Type, to, from func(interface{}) (interface{}, error)) error {
+	if t == nil {
+		return fmt.Errorf("cannot register converter for nil type")
+	}
+	if to == nil && from == nil {
+		return fmt.Errorf("converter for %s must provide at least one conversion", t)
+	}
+	c.mu.Lock()
+	c.converters[t] = &converter{to, from}
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *codec) converter(t reflect.Type) *converter {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.converters[t]
+}
+
+func (c *codec) setStrict(strict bool) {
+	c.mu.Lock()
+	c.strict = strict
+	c.mu.Unlock()
+}
+
+func (c *codec) isStrict() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.strict
+}
+
+func (c *codec) setNativeMaps(maps bool) {
+	c.mu.Lock()
+	c.maps = maps
+	c.mu.Unlock()
+}
+
+func (c *codec) nativeMaps() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.maps
+}
+
+// marshal converts a Go value into JSON suitable for handing to javascript.
+// time.Time values become Dates, maps with non-string keys become Maps
+// and map[T]struct{} values become Sets.
+func (c *codec) marshal(v interface{}) (string, error) {
+	if raw, ok := v.(Raw); ok {
+		return string(raw), nil
+	}
+	b := new(bytes.Buffer)
+	if err := c.encode(b, reflect.ValueOf(v)); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func (c *codec) encode(b *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		b.WriteString("null")
+		return nil
+	}
+	t := v.Type()
+	if conv := c.converter(t); conv != nil && conv.to != nil {
+		x, err := conv.to(v.Interface())
+		if err != nil {
+			return fmt.Errorf("cannot convert %s to javascript: %s", t, err.Error())
+		}
+		return c.encode(b, reflect.ValueOf(x))
+	}
+	switch {
+	case t == rawType:
+		b.WriteString(v.String())
+		return nil
+	case t.Implements(jsMarshalerType):
+		if t.Kind() == reflect.Ptr && v.IsNil() {
+			b.WriteString("null")
+			return nil
+		}
+		x, err := v.Interface().(JSMarshaler).MarshalJS()
+		if err != nil {
+			return fmt.Errorf("cannot convert %s to javascript: %s", t, err.Error())
+		}
+		return c.encode(b, reflect.ValueOf(x))
+	case t == timeType:
+		return c.encodeTagged(b, "Date", v.Interface().(time.Time).UnixMilli())
+	case t.Implements(marshalerType):
+		return encodeJSON(b, v)
+	}
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			b.WriteString("null")
+			return nil
+		}
+		return c.encode(b, v.Elem())
+	case reflect.Map:
+		if v.IsNil() {
+			b.WriteString("null")
+			return nil
+		}
+		if c.nativeMaps() {
+			if t.Elem() == emptyStructType {
+				return c.encodeSet(b, v)
+			}
+			if t.Key().Kind() != reflect.String {
+				return c.encodeMap(b, v)
+			}
+		}
+		return c.encodeObject(b, v)
+	case reflect.Slice:
+		if v.IsNil() {
+			b.WriteString("null")
+			return nil
+		}
+		if t.Elem().Kind() == reflect.Uint8 {
+			return encodeJSON(b, v)
+		}
+		return c.encodeArray(b, v)
+	case reflect.Array:
+		return c.encodeArray(b, v)
+	case reflect.Struct:
+		return c.encodeStruct(b, v)
+	}
+	return encodeJSON(b, v)
+}
+
+// encodeJSON falls back to encoding/json for everything we don't
+// need to treat specially
+func encodeJSON(b *bytes.Buffer, v reflect.Value) error {
+	data, err := json.Marshal(v.Interface())
+	if err != nil {
+		return err
+	}
+	b.Write(data)
+	return nil
+}
+
+func (c *codec) encodeTagged(b *bytes.Buffer, tag string, value interface{}) error {
+	fmt.Fprintf(b, `{%q:%q,"value":`, tagKey, tag)
+	if err := c.encode(b, reflect.ValueOf(value)); err != nil {
+		return err
+	}
+	b.WriteByte('}')
+	return nil
+}
+
+func (c *codec) encodeArray(b *bytes.Buffer, v reflect.Value) error {
+	b.WriteByte('[')
+	for i := 0; i < v.Len(); i++ {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		if err := c.encode(b, v.Index(i)); err != nil {
+			return err
+		}
+	}
+	b.WriteByte(']')
+	return nil
+}
+
+// encodeObject encodes a map as a plain object, keys are converted to
+// strings and sorted as encoding/json would
+func (c *codec) encodeObject(b *bytes.Buffer, v reflect.Value) error {
+	entries := make([]mapEntry, 0, v.Len())
+	for _, k := range v.MapKeys() {
+		name, err := objectKey(k)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, mapEntry{name, k})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	b.WriteByte('{')
+	for i, e := range entries {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.Quote(escapeKey(e.key)))
+		b.WriteByte(':')
+		if err := c.encode(b, v.MapIndex(e.k)); err != nil {
+			return err
+		}
+	}
+	b.WriteByte('}')
+	return nil
+}
+
+// mapEntry is a map key along with its encoded form
+type mapEntry struct {
+	key string
+	k   reflect.Value
+}
+
+// objectKey returns the object key for the map key k, following the rules
+// of encoding/json
+func objectKey(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	if tm, ok := k.Interface().(encoding.TextMarshaler); ok {
+		if k.Kind() == reflect.Ptr && k.IsNil() {
+			return "", nil
+		}
+		b, err := tm.MarshalText()
+		return string(b), err
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("unsupported map key type %s", k.Type())
+}
+
+// encodedKeys returns the keys of the map v in javascript form, sorted so
+// that Maps and Sets are built in a stable order
+func (c *codec) encodedKeys(v reflect.Value) ([]mapEntry, error) {
+	entries := make([]mapEntry, 0, v.Len())
+	for _, k := range v.MapKeys() {
+		var kb bytes.Buffer
+		if err := c.encode(&kb, k); err != nil {
+			return nil, err
+		}
+		entries = append(entries, mapEntry{kb.String(), k})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	return entries, nil
+}
+
+func (c *codec) encodeStruct(b *bytes.Buffer, v reflect.Value) error {
+	b.WriteByte('{')
+	n := 0
+	for _, f := range fieldsOf(v.Type()) {
+		fv, ok := fieldByIndex(v, f.index, false)
+		if !ok || (f.omitEmpty && isEmpty(fv)) {
+			continue
+		}
+		if n > 0 {
+			b.WriteByte(',')
+		}
+		n++
+		b.WriteString(strconv.Quote(escapeKey(f.name)))
+		b.WriteByte(':')
+		if err := c.encode(b, fv); err != nil {
+			return err
+		}
+	}
+	b.WriteByte('}')
+	return nil
+}
+
+func (c *codec) encodeMap(b *bytes.Buffer, v reflect.Value) error {
+	entries, err := c.encodedKeys(v)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(b, `{%q:"Map","value":[`, tagKey)
+	for i, e := range entries {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteByte('[')
+		b.WriteString(e.key)
+		b.WriteByte(',')
+		if err := c.encode(b, v.MapIndex(e.k)); err != nil {
+			return err
+		}
+		b.WriteByte(']')
+	}
+	b.WriteString("]}")
+	return nil
+}
+
+func (c *codec) encodeSet(b *bytes.Buffer, v reflect.Value) error {
+	entries, err := c.encodedKeys(v)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(b, `{%q:"Set","value":[`, tagKey)
+	for i, e := range entries {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(e.key)
+	}
+	b.WriteString("]}")
+	return nil
+}
+
+// callSource builds javascript that calls the function at path with args
+func (c *codec) callSource(path string, args []interface{}) (string, error) {
+	if args == nil {
+		args = []interface{}{}
+	}
+	argjson, err := c.marshal(args)
+	if err != nil {
+		return "", err
+	}
+	quoted, err := json.Marshal(argjson)
+	if err != nil {
+		return "", err
+	}
+	recv, name := "this", path
+	if i := strings.LastIndex(path, "."); i >= 0 {
+		recv, name = path[:i], path[i+1:]
+	}
+	qname, err := json.Marshal(name)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("(function(o){ return o[%s].apply(o, %s(%s)); })(%s)",
+		qname, parseKey, quoted, recv), nil
+}
+
+// unmarshal decodes JSON produced by javascript into the value pointed to by v.
+func (c *codec) unmarshal(data []byte, v interface{}) error {
+	if raw, ok := v.(*Raw); ok {
+		*raw = Raw(data)
+		return nil
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return &json.InvalidUnmarshalError{Type: reflect.TypeOf(v)}
+	}
+	var x interface{}
+	if len(data) > 0 { // undefined has no JSON form, treat it as null
+		if err := json.Unmarshal(data, &x); err != nil {
+			return err
+		}
+	}
+	x, err := revive(x)
+	if err != nil {
+		return err
+	}
+	return c.assign(rv.Elem(), x)
+}
+
+// revive walks a decoded JSON value replacing tagged objects with
+// time.Time, jsMap and jsSet values.
+func revive(x interface{}) (interface{}, error) {
+	var err error
+	switch x := x.(type) {
+	case []interface{}:
+		for i := range x {
+			if x[i], err = revive(x[i]); err != nil {
+				return nil, err
+			}
+		}
+	case map[string]interface{}:
+		if tag, ok := x[tagKey].(string); ok {
+			return reviveTagged(tag, x["value"])
+		}
+		var escaped []string
+		for k := range x {
+			if x[k], err = revive(x[k]); err != nil {
+				return nil, err
+			}
+			if unescapeKey(k) != k {
+				escaped = append(escaped, k)
+			}
+		}
+		// escaped keys never collide once unescaped, but must be renamed
+		// shortest first so a longer one doesn't overwrite it
+		sort.Slice(escaped, func(i, j int) bool { return len(escaped[i]) < len(escaped[j]) })
+		for _, k := range escaped {
+			x[unescapeKey(k)] = x[k]
+			delete(x, k)
+		}
+	}
+	return x, nil
+}
+
+func reviveTagged(tag string, value interface{}) (interface{}, error) {
+	switch tag {
+	case "Date":
+		if value == nil { // invalid dates
+			return nil, nil
+		}
+		ms, ok := value.(float64)
+		if !ok {
+			return nil, fmt.Errorf("invalid Date value %v", value)
+		}
+		return time.UnixMilli(int64(ms)), nil
+	case "Map":
+		entries, _ := value.([]interface{})
+		m := make(jsMap, len(entries))
+		for i, e := range entries {
+			kv, ok := e.([]interface{})
+			if !ok || len(kv) != 2 {
+				return nil, fmt.Errorf("invalid Map entry %v", e)
+			}
+			for j := range kv {
+				x, err := revive(kv[j])
+				if err != nil {
+					return nil, err
+				}
+				m[i][j] = x
+			}
+		}
+		return m, nil
+	case "Set":
+		values, _ := value.([]interface{})
+		s := make(jsSet, len(values))
+		for i := range values {
+			x, err := revive(values[i])
+			if err != nil {
+				return nil, err
+			}
+			s[i] = x
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("unknown tagged type %q", tag)
+}
+
+// untag converts tagged JSON into the plain JSON that JSON.stringify gives
+// without the replacer, as wanted when scanning into Raw: Dates become ISO
+// strings, Maps and Sets empty objects and escaped keys are restored. Key
+// order is kept.
+func untag(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var b bytes.Buffer
+	if err := untagValue(dec, &b); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func untagValue(dec *json.Decoder, b *bytes.Buffer) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok {
+	case json.Delim('['):
+		b.WriteByte('[')
+		for i := 0; dec.More(); i++ {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			if err := untagValue(dec, b); err != nil {
+				return err
+			}
+		}
+		b.WriteByte(']')
+		_, err = dec.Token()
+		return err
+	case json.Delim('{'):
+		b.WriteByte('{')
+		for i := 0; dec.More(); i++ {
+			tok, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			k, _ := tok.(string)
+			if i == 0 && k == tagKey {
+				b.Truncate(b.Len() - 1)
+				return untagTagged(dec, b)
+			}
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			if err := writeJSON(b, unescapeKey(k)); err != nil {
+				return err
+			}
+			b.WriteByte(':')
+			if err := untagValue(dec, b); err != nil {
+				return err
+			}
+		}
+		b.WriteByte('}')
+		_, err = dec.Token()
+		return err
+	}
+	return writeJSON(b, tok)
+}
+
+// untagTagged writes the plain form of the tagged object being decoded,
+// whose tag key has just been read
+func untagTagged(dec *json.Decoder, b *bytes.Buffer) error {
+	var tag string
+	if err := dec.Decode(&tag); err != nil {
+		return err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		var value interface{}
+		if err := dec.Decode(&value); err != nil {
+			return err
+		}
+		if tok != "value" {
+			continue
+		}
+		switch tag {
+		case "Date":
+			ms, ok := value.(json.Number)
+			if !ok { // invalid dates
+				b.WriteString("null")
+				continue
+			}
+			f, err := ms.Float64()
+			if err != nil {
+				return err
+			}
+			t := time.UnixMilli(int64(f)).UTC()
+			if err := writeJSON(b, t.Format("2006-01-02T15:04:05.000Z")); err != nil {
+				return err
+			}
+		case "Map", "Set":
+			b.WriteString("{}")
+		default:
+			return fmt.Errorf("unknown tagged type %q", tag)
+		}
+	}
+	_, err := dec.Token()
+	return err
+}
+
+// writeJSON writes x to b as JSON without escaping HTML characters, as
+// JSON.stringify does
+func writeJSON(b *bytes.Buffer, x interface{}) error {
+	enc := json.NewEncoder(b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(x); err != nil {
+		return err
+	}
+	b.Truncate(b.Len() - 1) // trailing newline
+	return nil
+}
+
+// plain converts a revived value into the types used when the
+// destination is an interface{}: Maps become map[interface{}]interface{}
+// and Sets become []interface{}.
+func plain(x interface{}) (interface{}, error) {
+	var err error
+	switch x := x.(type) {
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i := range x {
+			if out[i], err = plain(x[i]); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(x))
+		for k := range x {
+			if out[k], err = plain(x[k]); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case jsSet:
+		return plain([]interface{}(x))
+	case jsMap:
+		out := make(map[interface{}]interface{}, len(x))
+		for _, e := range x {
+			k, err := plain(e[0])
+			if err != nil {
+				return nil, err
+			}
+			if k != nil && !reflect.TypeOf(k).Comparable() {
+				return nil, fmt.Errorf("cannot use %s as a Go map key", kindOf(k))
+			}
+			if out[k], err = plain(e[1]); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return x, nil
+}
+
+// try to convert v to something that is assignable to type t
+func (c *codec) cast(v interface{}, t reflect.Type) (reflect.Value, error) {
+	x := reflect.New(t).Elem()
+	err := c.assign(x, v)
+	return x, err
+}
+
+// assign stores the revived value src into dst converting as required
+func (c *codec) assign(dst reflect.Value, src interface{}) error {
+	t := dst.Type()
+	if conv := c.converter(t); conv != nil && conv.from != nil {
+		x, err := plain(src)
+		if err != nil {
+			return err
+		}
+		x, err = conv.from(x)
+		if err != nil {
+			return fmt.Errorf("cannot cast %s to %s: %s", kindOf(src), t, err.Error())
+		}
+		xv := reflect.ValueOf(x)
+		if !xv.IsValid() {
+			dst.Set(reflect.Zero(t))
+			return nil
+		}
+		if !xv.Type().AssignableTo(t) {
+			return fmt.Errorf("converter for %s returned %s", t, xv.Type())
+		}
+		dst.Set(xv)
+		return nil
+	}
+	if src == nil {
+		dst.Set(reflect.Zero(t))
+		return nil
+	}
+	if t.Kind() != reflect.Ptr && reflect.PtrTo(t).Implements(jsUnmarshalerType) {
+		x, err := plain(src)
+		if err != nil {
+			return err
+		}
+		if dst.CanAddr() {
+			return dst.Addr().Interface().(JSUnmarshaler).UnmarshalJS(x)
+		}
+		vv := reflect.New(t)
+		if err := vv.Interface().(JSUnmarshaler).UnmarshalJS(x); err != nil {
+			return err
+		}
+		dst.Set(vv.Elem())
+		return nil
+	}
+	if t == timeType {
+		return assignTime(dst, src)
+	}
+	if t.Kind() != reflect.Ptr && reflect.PtrTo(t).Implements(unmarshalerType) {
+		return assignJSON(dst, src)
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		if dst.IsNil() {
+			dst.Set(reflect.New(t.Elem()))
+		}
+		return c.assign(dst.Elem(), src)
+	case reflect.Interface:
+		x, err := plain(src)
+		if err != nil {
+			return err
+		}
+		xv := reflect.ValueOf(x)
+		if !xv.Type().AssignableTo(t) {
+			return fmt.Errorf("cannot cast %s to %s", kindOf(src), t)
+		}
+		dst.Set(xv)
+		return nil
+	case reflect.Map:
+		return c.assignMap(dst, src)
+	case reflect.Slice, reflect.Array:
+		if _, ok := src.(string); ok {
+			return assignJSON(dst, src) // base64 encoded []byte
+		}
+		return c.assignList(dst, src)
+	case reflect.Struct:
+		return c.assignStruct(dst, src)
+	}
+	v := reflect.ValueOf(src)
+	if !v.Type().AssignableTo(t) {
+		if !v.Type().ConvertibleTo(t) {
+			return fmt.Errorf("cannot cast %s to %s", kindOf(src), t.Kind())
+		}
+		if n, ok := src.(float64); ok && c.isStrict() && lossy(n, t) {
+			return fmt.Errorf("cannot cast number %v to %s without loss", n, t.Kind())
+		}
+		v = v.Convert(t)
+	}
+	dst.Set(v)
+	return nil
+}
+
+// lossy reports whether converting n to the integer type t would
+// truncate or overflow it.
+func lossy(n float64, t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n != math.Trunc(n) || n < math.MinInt64 || n >= math.MaxInt64 {
+			return true
+		}
+		return reflect.Zero(t).OverflowInt(int64(n))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n != math.Trunc(n) || n < 0 || n >= math.MaxUint64 {
+			return true
+		}
+		return reflect.Zero(t).OverflowUint(uint64(n))
+	}
+	return false
+}
+
+func assignTime(dst reflect.Value, src interface{}) error {
+	switch x := src.(type) {
+	case time.Time:
+		dst.Set(reflect.ValueOf(x))
+	case float64:
+		dst.Set(reflect.ValueOf(time.UnixMilli(int64(x))))
+	case string:
+		d, err := time.Parse(time.RFC3339, x)
+		if err != nil {
+			return fmt.Errorf("cannot cast string to time.Time: %s", err.Error())
+		}
+		dst.Set(reflect.ValueOf(d))
+	default:
+		return fmt.Errorf("cannot cast %s to time.Time", kindOf(src))
+	}
+	return nil
+}
+
+func (c *codec) assignMap(dst reflect.Value, src interface{}) error {
+	t := dst.Type()
+	if dst.IsNil() {
+		dst.Set(reflect.MakeMap(t))
+	}
+	setKey := func(k interface{}, v interface{}) error {
+		kv := reflect.New(t.Key()).Elem()
+		if err := c.assign(kv, k); err != nil {
+			return err
+		}
+		vv := reflect.New(t.Elem()).Elem()
+		if err := c.assign(vv, v); err != nil {
+			return err
+		}
+		dst.SetMapIndex(kv, vv)
+		return nil
+	}
+	switch x := src.(type) {
+	case map[string]interface{}:
+		for k, v := range x {
+			var key interface{} = k
+			switch t.Key().Kind() {
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+				reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+				reflect.Float32, reflect.Float64:
+				n, err := strconv.ParseFloat(k, 64)
+				if err != nil {
+					return fmt.Errorf("cannot cast object key %q to %s", k, t.Key().Kind())
+				}
+				key = n
+			}
+			if err := setKey(key, v); err != nil {
+				return err
+			}
+		}
+	case jsMap:
+		for _, e := range x {
+			if err := setKey(e[0], e[1]); err != nil {
+				return err
+			}
+		}
+	case jsSet:
+		var member interface{}
+		switch {
+		case t.Elem() == emptyStructType:
+			member = map[string]interface{}{}
+		case t.Elem().Kind() == reflect.Bool:
+			member = true
+		default:
+			return fmt.Errorf("cannot cast Set to %s", t)
+		}
+		for _, k := range x {
+			if err := setKey(k, member); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cannot cast %s to %s", kindOf(src), t.Kind())
+	}
+	return nil
+}
+
+func (c *codec) assignList(dst reflect.Value, src interface{}) error {
+	var items []interface{}
+	switch x := src.(type) {
+	case []interface{}:
+		items = x
+	case jsSet:
+		items = x
+	default:
+		return fmt.Errorf("cannot cast %s to %s", kindOf(src), dst.Type().Kind())
+	}
+	if dst.Kind() == reflect.Slice {
+		dst.Set(reflect.MakeSlice(dst.Type(), len(items), len(items)))
+	}
+	for i := 0; i < len(items) && i < dst.Len(); i++ {
+		if err := c.assign(dst.Index(i), items[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// assignStruct fills the fields of dst from a javascript object following
+// the same field naming rules as encoding/json. Fields not present in
+// the object are left untouched.
+func (c *codec) assignStruct(dst reflect.Value, src interface{}) error {
+	obj, ok := src.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("cannot cast %s to %s", kindOf(src), dst.Type().Kind())
+	}
+	if !dst.CanAddr() { // work on a copy so that fields are settable
+		vv := reflect.New(dst.Type()).Elem()
+		vv.Set(dst)
+		if err := c.assignStruct(vv, src); err != nil {
+			return err
+		}
+		dst.Set(vv)
+		return nil
+	}
+	fields := fieldsOf(dst.Type())
+	for k, v := range obj {
+		f := lookupField(fields, k)
+		if f == nil {
+			continue
+		}
+		fv, ok := fieldByIndex(dst, f.index, true)
+		if !ok {
+			continue
+		}
+		if err := c.assign(fv, v); err != nil {
+			return fmt.Errorf("%s: %s", f.name, err.Error())
+		}
+	}
+	return nil
+}
+
+// assignJSON round-trips src through encoding/json so that types
+// implementing json.Unmarshaler can be filled.
+func assignJSON(dst reflect.Value, src interface{}) error {
+	x, err := plain(src)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(x)
+	if err != nil {
+		return fmt.Errorf("cannot cast %s to %s: %s", kindOf(src), dst.Type().Kind(), err.Error())
+	}
+	if dst.CanAddr() { // unmarshal in place like json.Unmarshal would
+		err = json.Unmarshal(b, dst.Addr().Interface())
+	} else {
+		vv := reflect.New(dst.Type())
+		if err = json.Unmarshal(b, vv.Interface()); err == nil {
+			dst.Set(vv.Elem())
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("cannot cast %s to %s: %s", kindOf(src), dst.Type().Kind(), err.Error())
+	}
+	return nil
+}
+
+// kindOf names the javascript type of a revived value for error messages
+func kindOf(x interface{}) string {
+	switch x.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	case time.Time:
+		return "Date"
+	case jsMap:
+		return "Map"
+	case jsSet:
+		return "Set"
+	}
+	return reflect.TypeOf(x).Kind().String()
+}
+
+// typeName names the javascript type expected when converting to t
+func (c *codec) typeName(t reflect.Type) string {
+	if c.converter(t) != nil || reflect.PtrTo(t).Implements(jsUnmarshalerType) {
+		return t.String()
+	}
+	switch {
+	case t == timeType:
+		return "Date"
+	case t == rawType:
+		return "string"
+	case t.Kind() != reflect.Ptr && reflect.PtrTo(t).Implements(unmarshalerType):
+		return t.String()
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return c.typeName(t.Elem())
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Map:
+		if !c.nativeMaps() {
+			return "object"
+		}
+		if t.Elem() == emptyStructType {
+			return "Set"
+		}
+		if t.Key().Kind() != reflect.String {
+			return "Map"
+		}
+		return "object"
+	case reflect.Struct:
+		return "object"
+	case reflect.Interface:
+		return "any"
+	}
+	return t.String()
+}
+
+// field describes how a struct field is named in javascript
+type field struct {
+	name      string
+	index     []int
+	tagged    bool // named by a json tag
+	omitEmpty bool
+}
+
+var fieldCache sync.Map // map[reflect.Type][]field
+
+// fieldsOf returns the exported fields of struct type t, including the
+// fields of embedded structs, named and chosen following the rules of
+// encoding/json: of the fields sharing a name the shallowest wins, then
+// one named by a json tag, and if that still leaves more than one the
+// name is dropped altogether.
+func fieldsOf(t reflect.Type) []field {
+	if fs, ok := fieldCache.Load(t); ok {
+		return fs.([]field)
+	}
+	type level struct {
+		t     reflect.Type
+		index []int
+	}
+	var candidates []field
+	current := []level{}
+	next := []level{{t: t}}
+	visited := map[reflect.Type]bool{}
+	for len(next) > 0 {
+		current, next = next, current[:0]
+		// count of each name at this depth, a struct embedded more than
+		// once at the same depth makes its fields ambiguous
+		count := map[reflect.Type]int{}
+		for _, l := range current {
+			count[l.t]++
+		}
+		for _, l := range current {
+			if visited[l.t] {
+				continue
+			}
+			visited[l.t] = true
+			for i := 0; i < l.t.NumField(); i++ {
+				f := l.t.Field(i)
+				ft := f.Type
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if f.Anonymous {
+					if f.PkgPath != "" && ft.Kind() != reflect.Struct {
+						continue // unexported non-struct embeds are ignored
+					}
+				} else if f.PkgPath != "" {
+					continue
+				}
+				tag := f.Tag.Get("json")
+				if tag == "-" {
+					continue
+				}
+				name, opts, _ := strings.Cut(tag, ",")
+				idx := append(append([]int{}, l.index...), i)
+				if name != "" || !f.Anonymous || ft.Kind() != reflect.Struct {
+					fld := field{
+						name:      name,
+						index:     idx,
+						tagged:    name != "",
+						omitEmpty: strings.Contains(","+opts+",", ",omitempty,"),
+					}
+					if fld.name == "" {
+						fld.name = f.Name
+					}
+					candidates = append(candidates, fld)
+					if count[l.t] > 1 {
+						// the field is reachable twice at this depth,
+						// add it again so it is dropped as ambiguous
+						candidates = append(candidates, fld)
+					}
+					continue
+				}
+				next = append(next, level{t: ft, index: idx})
+			}
+		}
+	}
+	// group by name, shallowest then tagged first
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		if len(a.index) != len(b.index) {
+			return len(a.index) < len(b.index)
+		}
+		return a.tagged && !b.tagged
+	})
+	var fields []field
+	for i := 0; i < len(candidates); {
+		j := i + 1
+		for j < len(candidates) && candidates[j].name == candidates[i].name {
+			j++
+		}
+		if f, ok := dominantField(candidates[i:j]); ok {
+			fields = append(fields, f)
+		}
+		i = j
+	}
+	// back into declaration order
+	sort.Slice(fields, func(i, j int) bool {
+		a, b := fields[i].index, fields[j].index
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+	fs, _ := fieldCache.LoadOrStore(t, fields)
+	return fs.([]field)
+}
+
+// dominantField picks the field that wins among fields sharing a name,
+// sorted shallowest then tagged first. It fails if none dominates.
+func dominantField(fields []field) (field, bool) {
+	if len(fields) > 1 && len(fields[0].index) == len(fields[1].index) && fields[0].tagged == fields[1].tagged {
+		return field{}, false
+	}
+	return fields[0], true
+}
+
+// isEmpty reports whether v is empty in the omitempty sense
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Struct:
+		return false
+	}
+	return v.IsZero()
+}
+
+// lookupField finds the field for a javascript property name, preferring
+// an exact match but falling back to a case-insensitive one.
+func lookupField(fields []field, name string) *field {
+	var fold *field
+	for i := range fields {
+		if fields[i].name == name {
+			return &fields[i]
+		}
+		if fold == nil && strings.EqualFold(fields[i].name, name) {
+			fold = &fields[i]
+		}
+	}
+	return fold
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex but copes with nil
+// embedded pointers, allocating them if alloc is true.
+func fieldByIndex(v reflect.Value, index []int, alloc bool) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !alloc || !v.CanSet() {
+					return reflect.Value{}, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
@@ -0,0 +1,441 @@
+package jsapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFunctionWithDateArg(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	cx.DefineFunction("year", func(d time.Time) int {
+		return d.UTC().Year()
+	})
+
+	var i int
+	err := cx.Eval(`year(new Date('2012-06-01'))`, &i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 2012 {
+		t.Fatalf("expected year(new Date('2012-06-01')) to return 2012 but got %d", i)
+	}
+
+}
+
+func TestFunctionReturningDate(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	cx.DefineFunction("epoch", func() time.Time {
+		return time.Unix(0, 0)
+	})
+
+	var ok bool
+	err := cx.Eval(`epoch() instanceof Date && epoch().getTime() === 0`, &ok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatalf("expected epoch() to return a javascript Date for the unix epoch")
+	}
+
+}
+
+func TestProxyObjectDateField(t *testing.T) {
+
+	type Event struct {
+		When time.Time
+	}
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	ev := &Event{time.Date(2012, 1, 1, 0, 0, 0, 0, time.UTC)}
+	cx.DefineObject("ev", ev)
+
+	var year int
+	err := cx.Eval(`ev.when.getUTCFullYear()`, &year)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if year != 2012 {
+		t.Fatalf("expected ev.when to be a Date in 2012 but got year %d", year)
+	}
+
+	err = cx.Exec(`ev.when = new Date(Date.UTC(2014, 0, 1))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.When.UTC().Year() != 2014 {
+		t.Fatalf("expected to set ev.When to a time in 2014 but got %v", ev.When)
+	}
+
+}
+
+func TestEvalMap(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	var m map[int]string
+	err := cx.Eval(`new Map([[1, 'a'], [2, 'b']])`, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 || m[1] != "a" || m[2] != "b" {
+		t.Fatalf("expected Map to scan into map[int]string{1:a 2:b} got %v", m)
+	}
+
+	var x interface{}
+	err = cx.Eval(`new Map([[true, new Date(0)]])`, &x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xm, ok := x.(map[interface{}]interface{})
+	if !ok {
+		t.Fatalf("expected Map to scan into map[interface{}]interface{} got %T", x)
+	}
+	if d, ok := xm[true].(time.Time); !ok || !d.Equal(time.Unix(0, 0)) {
+		t.Fatalf("expected Map value to be the unix epoch got %v", xm[true])
+	}
+
+}
+
+func TestTagKeyRoundTrip(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	var m map[string]interface{}
+	err := cx.Eval(`({__jsapi__: 'Date', value: 5, ___jsapi__: 'x'})`, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m["__jsapi__"] != "Date" || m["value"] != 5.0 || m["___jsapi__"] != "x" {
+		t.Fatalf("expected object with a __jsapi__ key to scan as a plain map but got %#v", m)
+	}
+
+	cx.DefineFunction("echo", func(m map[string]interface{}) map[string]interface{} {
+		return m
+	})
+	var ok bool
+	err = cx.Eval(`
+		var o = echo({__jsapi__: 'Set', value: [1], ___jsapi__: 'x'});
+		o.__jsapi__ === 'Set' && o.value[0] === 1 && o.___jsapi__ === 'x'
+	`, &ok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatalf("expected object with a __jsapi__ key to survive a round trip through Go")
+	}
+
+}
+
+func TestFunctionReturningMap(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	cx.DefineFunction("squares", func() map[int]int {
+		return map[int]int{2: 4, 3: 9}
+	})
+
+	var i int
+	err := cx.Eval(`var m = squares(); m instanceof Map ? -1 : m[2] + m[3]`, &i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 13 {
+		t.Fatalf("expected squares() to return an object summing to 13 but got %d", i)
+	}
+
+	cx.SetNativeMaps(true)
+	err = cx.Eval(`var m = squares(); m instanceof Map ? m.get(2) + m.get(3) : -1`, &i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 13 {
+		t.Fatalf("expected squares() to return a Map summing to 13 but got %d", i)
+	}
+
+}
+
+func TestEvalSet(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	var s []string
+	err := cx.Eval(`new Set(['a', 'b', 'a'])`, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s) != 2 || s[0] != "a" || s[1] != "b" {
+		t.Fatalf("expected Set to scan into []string{a b} got %v", s)
+	}
+
+	var m map[string]struct{}
+	err = cx.Eval(`new Set(['x', 'y'])`, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "x" || keys[1] != "y" {
+		t.Fatalf("expected Set to scan into map[string]struct{}{x y} got %v", m)
+	}
+
+}
+
+func TestFunctionWithSetArg(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	cx.DefineFunction("has", func(set map[float64]struct{}, x float64) bool {
+		_, ok := set[x]
+		return ok
+	})
+
+	var ok bool
+	err := cx.Eval(`has(new Set([1, 2, 3]), 2) && !has(new Set([1]), 2)`, &ok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatalf("expected Set argument to arrive as map[float64]struct{}")
+	}
+
+}
+
+type cents int64
+
+func (c cents) MarshalJS() (interface{}, error) {
+	return fmt.Sprintf("%d.%02d", c/100, c%100), nil
+}
+
+func (c *cents) UnmarshalJS(v interface{}) error {
+	s, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("expected a string got %T", v)
+	}
+	var units, frac int64
+	if _, err := fmt.Sscanf(s, "%d.%d", &units, &frac); err != nil {
+		return err
+	}
+	*c = cents(units*100 + frac)
+	return nil
+}
+
+func TestJSMarshaler(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	type item struct {
+		Price cents
+	}
+
+	cx.DefineFunction("double", func(x item) item {
+		x.Price *= 2
+		return x
+	})
+
+	var s string
+	err := cx.Eval(`double({price: '1.25'}).price`, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "2.50" {
+		t.Fatalf(`expected double({price: '1.25'}).price to return "2.50" but got %q`, s)
+	}
+
+	var c cents
+	err = cx.Eval(`'3.05'`, &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != 305 {
+		t.Fatalf("expected Eval to scan '3.05' into 305 cents but got %d", c)
+	}
+
+}
+
+func TestRegisterConverter(t *testing.T) {
+
+	type upper struct {
+		s string
+	}
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	err := cx.RegisterConverter(reflect.TypeOf(upper{}),
+		func(v interface{}) (interface{}, error) {
+			return strings.ToLower(v.(upper).s), nil
+		},
+		func(v interface{}) (interface{}, error) {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected a string got %T", v)
+			}
+			return upper{strings.ToUpper(s)}, nil
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cx.DefineFunction("shout", func(u upper) upper {
+		return upper{u.s + "!"}
+	})
+
+	var s string
+	err = cx.Eval(`shout('hey')`, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "hey!" {
+		t.Fatalf(`expected shout('hey') to return "hey!" but got %q`, s)
+	}
+
+	type holder struct {
+		Word upper
+	}
+	h := &holder{upper{"HELLO"}}
+	cx.DefineObject("h", h)
+
+	err = cx.Eval(`h.word`, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "hello" {
+		t.Fatalf(`expected h.word to be "hello" but got %q`, s)
+	}
+
+	err = cx.Exec(`h.word = 'bye'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Word.s != "BYE" {
+		t.Fatalf(`expected h.Word to be set to "BYE" but got %q`, h.Word.s)
+	}
+
+	var u upper
+	err = cx.Eval(`'eval'`, &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.s != "EVAL" {
+		t.Fatalf(`expected Eval to scan into upper{"EVAL"} but got %q`, u.s)
+	}
+
+	err = cx.Exec(`shout(1)`)
+	if err == nil {
+		t.Fatalf("expected converter error to be returned")
+	}
+
+}
+
+func TestStructFieldNames(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	type base struct {
+		ID int `json:"id"`
+	}
+	type doc struct {
+		base
+		Title   string
+		Secret  string `json:"-"`
+		Missing string `json:",omitempty"`
+	}
+
+	cx.DefineFunction("echo", func(d doc) doc {
+		return d
+	})
+
+	var s string
+	err := cx.Eval(`JSON.stringify(echo({id: 7, title: 'x', Secret: 's'}))`, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := `{"id":7,"Title":"x"}`
+	if s != exp {
+		t.Fatalf("expected %s but got %s", exp, s)
+	}
+
+}
+
+type shadowInner struct {
+	Name  string
+	Level string
+	Tag   string
+}
+
+type shadowOther struct {
+	Level string
+	Tag   string `json:"Tag"`
+}
+
+func TestStructFieldShadowing(t *testing.T) {
+
+	// Inner.Name is shadowed by the shallower Name, Level is ambiguous
+	// between the embedded structs and the tagged Tag dominates
+	type outer struct {
+		shadowInner
+		shadowOther
+		Name string
+	}
+	v := outer{shadowInner{"inner", "a", "b"}, shadowOther{"c", "d"}, "outer"}
+
+	s, err := newCodec().marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != string(exp) {
+		t.Fatalf("expected struct to be named as encoding/json would %s but got %s", exp, s)
+	}
+
+}
+
+func TestMapKeysAsObject(t *testing.T) {
+
+	c := newCodec()
+	s, err := c.marshal(map[int]string{10: "b", 2: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, _ := json.Marshal(map[int]string{10: "b", 2: "a"})
+	if s != string(exp) {
+		t.Fatalf("expected %s but got %s", exp, s)
+	}
+
+	c.setNativeMaps(true)
+	s, err = c.marshal(map[int]string{10: "b", 2: "a", 1: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != `{"__jsapi__":"Map","value":[[1,"c"],[10,"b"],[2,"a"]]}` {
+		t.Fatalf("expected Map entries in a stable order but got %s", s)
+	}
+
+}
@@ -4,19 +4,27 @@ package jsapi
 /*
 #cgo LDFLAGS: -L./lib -L./src/github.com/jsapi/lib -L./src/github.com/jaspi/lib/moz/js/src/build-release/dist/lib -L./lib/moz/js/src/build-release/dist/lib -ljsapi -l:libjs.a -lpthread -lstdc++ -ldl -l:libnspr4.a
 #include <stdlib.h>
+#include <time.h>
 #include "lib/js.hpp"
 void Init();
 */
 import "C"
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"reflect"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
@@ -83,7 +91,39 @@ func init() {
 	jsapi = start()
 }
 
-var contexts = make(map[int]*Context)
+// registry maps ids to Contexts for the callbacks from C, which arrive
+// on the worker threads of many Contexts at once
+type registry struct {
+	mu sync.RWMutex
+	m  map[int]*Context
+}
+
+var contexts = &registry{m: make(map[int]*Context)}
+
+func (r *registry) get(id int) (*Context, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cx, ok := r.m[id]
+	return cx, ok
+}
+
+func (r *registry) add(cx *Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.m[cx.id] = cx
+}
+
+func (r *registry) remove(id int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.m, id)
+}
+
+func (r *registry) len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.m)
+}
 
 type destroyer interface {
 	Destroy()
@@ -97,36 +137,38 @@ func finalizer(x destroyer) {
 func workerWait(id C.int, ptr *C.JSAPIContext) {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
-	cx, ok := contexts[int(id)]
+	cx, ok := contexts.get(int(id))
 	if !ok {
 		panic("attempt to wait on a non existant context worker")
 	}
+	cx.ptr = ptr
 	cx.ready <- nil
 	for {
 		select {
-		case fn, ok := <-cx.in:
-			if !ok {
-				return
-			}
+		case fn := <-cx.in:
 			fn.call(ptr)
 			fn.done <- true
+		case <-cx.closed:
+			close(cx.exited)
+			return
 		}
 	}
 }
 
 //export workerFail
 func workerFail(id C.int, err *C.char) {
-	cx, ok := contexts[int(id)]
+	cx, ok := contexts.get(int(id))
 	if !ok {
 		panic("attempt to wait on a non existant context worker")
 	}
 	cx.ready <- fmt.Errorf("worker %d: %s", int(id), C.GoString(err))
+	close(cx.exited)
 }
 
 //export callFunction
 func callFunction(c *C.JSAPIContext, fid C.uint32_t, cname *C.char, args *C.char, argn C.int, out **C.char) C.int {
 	name := C.GoString(cname)
-	cx, ok := contexts[int(c.id)]
+	cx, ok := contexts.get(int(c.id))
 	if !ok {
 		*out = C.CString(fmt.Sprintf("attempt to call function %s on a destroyed context", name))
 		return 0
@@ -136,28 +178,74 @@ func callFunction(c *C.JSAPIContext, fid C.uint32_t, cname *C.char, args *C.char
 		*out = C.CString(fmt.Sprintf("attempt to call function %s that doesn't appear to exist in context", name))
 		return 0
 	}
+	exit, err := cx.enterQuota(fn.name)
+	if err != nil {
+		if qe, ok := err.(*QuotaExceeded); ok {
+			cx.quotaExceeded(qe)
+		}
+		*out = C.CString(err.Error())
+		return C.GO_QUOTA_ERROR
+	}
 	json := C.GoStringN(args, argn)
 	outjson, err := fn.call(json)
+	exit()
 	if err != nil {
 		*out = C.CString(err.Error())
+		if _, ok := err.(*typeError); ok {
+			return C.GO_TYPE_ERROR
+		}
 		return 0
 	}
 	*out = C.CString(outjson)
 	return 1
 }
 
+//export interrupt
+func interrupt(c *C.JSAPIContext) C.int {
+	cx, ok := contexts.get(int(c.id))
+	if !ok {
+		return C.GO_OK
+	}
+	if cx.interrupted() {
+		// keep interrupting so enclosing evaluations stop too
+		C.JSAPI_RequestInterrupt(c)
+		cx.stop(ErrInterrupted)
+		return C.GO_FAIL
+	}
+	if cx.budget == nil {
+		return C.GO_OK
+	}
+	// keep interrupting to count every operation
+	C.JSAPI_RequestInterrupt(c)
+	if !cx.budget.tick() {
+		cx.stop(ErrBudgetExceeded)
+		return C.GO_FAIL
+	}
+	return C.GO_OK
+}
+
 //export reporter
-func reporter(c *C.JSAPIContext, cfilename *C.char, lineno C.uint, cmsg *C.char) {
-	cx, ok := contexts[int(c.id)]
+func reporter(c *C.JSAPIContext, cfilename *C.char, lineno C.uint, cmsg *C.char, warning C.int) {
+	cx, ok := contexts.get(int(c.id))
 	if !ok {
 		return
 	}
-	cx.setError(C.GoString(cfilename), uint(lineno), C.GoString(cmsg))
+	r := &ErrorReport{
+		Filename: C.GoString(cfilename),
+		Line:     uint(lineno),
+		Message:  C.GoString(cmsg),
+		Warning:  warning != 0,
+	}
+	if r.Warning {
+		cx.warn(r)
+		return
+	}
+	cx.setError(r)
 }
 
 //export getprop
 func getprop(c *C.JSAPIContext, id C.uint32_t, cname *C.char, out **C.char) C.int {
-	cx, ok := contexts[int(c.id)]
+	cx, ok := contexts.get(int(c.id))
 	if !ok {
 		*out = C.CString("attempt to use context after destroyed")
 		return 0
@@ -173,7 +261,7 @@ func getprop(c *C.JSAPIContext, id C.uint32_t, cname *C.char, out **C.char) C.in
 		*out = C.CString("attempt to get property that doesn't appear to exist")
 		return 0
 	}
-	outjson, err := p.get()
+	outjson, err := cx.guard(p.name, p.get)
 	if err != nil {
 		*out = C.CString(err.Error())
 		return 0
@@ -184,7 +272,7 @@ func getprop(c *C.JSAPIContext, id C.uint32_t, cname *C.char, out **C.char) C.in
 
 //export setprop
 func setprop(c *C.JSAPIContext, id C.uint32_t, cname *C.char, val *C.char, valn C.int, out **C.char) C.int {
-	cx, ok := contexts[int(c.id)]
+	cx, ok := contexts.get(int(c.id))
 	if !ok {
 		*out = C.CString("attempt to use context after destroyed")
 		return 0
@@ -200,9 +288,14 @@ func setprop(c *C.JSAPIContext, id C.uint32_t, cname *C.char, val *C.char, valn
 		return 0
 	}
 	json := C.GoStringN(val, valn)
-	outjson, err := p.set(json)
+	outjson, err := cx.guard(p.name, func() (string, error) {
+		return p.set(json)
+	})
 	if err != nil {
 		*out = C.CString(err.Error())
+		if _, ok := err.(*typeError); ok {
+			return C.GO_TYPE_ERROR
+		}
 		return 0
 	}
 	*out = C.CString(outjson)
@@ -213,6 +306,9 @@ type ErrorReport struct {
 	Filename string
 	Line     uint
 	Message  string
+	Warning  bool           // reported to OnWarning rather than returned
+	Panic    *PanicError    // set if a Go panic caused the error, see PanicPolicy
+	Quota    *QuotaExceeded // set if a quota was exceeded, see Quota
 }
 
 func (err *ErrorReport) Error() string {
@@ -226,6 +322,29 @@ func (err *ErrorReport) String() string {
 	return err.Message
 }
 
+// Unwrap returns the Go panic or exceeded quota that caused the error,
+// if any.
+func (err *ErrorReport) Unwrap() error {
+	switch {
+	case err.Panic != nil:
+		return err.Panic
+	case err.Quota != nil:
+		return err.Quota
+	}
+	return nil
+}
+
+// typeError is returned when javascript passes values that cannot be
+// converted to the types a Go function or property expects. It is
+// thrown into javascript as a TypeError rather than a plain Error.
+type typeError struct {
+	msg string
+}
+
+func (err *typeError) Error() string {
+	return err.msg
+}
+
 // Types that implement Definer can create mappings of objects
 // and functions between javascript and Go
 type Definer interface {
@@ -241,6 +360,12 @@ type Evaluator interface {
 	ExecFrom(r io.Reader) (err error)
 }
 
+// Types that implement Caller can call javascript functions from Go
+type Caller interface {
+	Evaluator
+	Call(fn string, result interface{}, args ...interface{}) (err error)
+}
+
 // Context is a javascript runtime environment and global namespace. You run javascript
 // _within_ a context. You can think of it a bit like a tab in a browser, scripts
 // running in seperate Contexts cannot see or interact with each other.
@@ -249,100 +374,361 @@ type Evaluator interface {
 // for best results you should consider how to make best use of the Contexts and try to
 // keep the number you need to a minimum.
 type Context struct {
-	id    int
-	ptr   *C.JSAPIContext
-	ready chan error
-	in    chan *cxfn
-	objs  map[int]*Object
-	funcs map[int]*function
-	Valid bool
-	err  *ErrorReport
+	id      int
+	ptr     *C.JSAPIContext
+	ready   chan error
+	in      chan *cxfn
+	objs    map[int]*Object
+	funcs   map[int]*function
+	codec   *codec
+	ctx     context.Context // ctx of the running evaluation (worker thread only)
+	valid   int32           // 1 until closed (atomic)
+	frames  []*frame        // running evaluations, innermost last (worker thread only)
+	hookMu  sync.Mutex      // guards onWarn, onPanic, onQuota and policy
+	onWarn  func(*ErrorReport)
+	onPanic func(*PanicError)
+	onQuota func(*QuotaExceeded)
+	policy  PanicPolicy
+	quotas  quotas
+	budget  *budget        // innermost active Budget (worker thread only)
+	intrMu  sync.Mutex     // guards gen and target, see Interrupt
+	gen     int64          // counts starts and ends of evaluations, odd while running
+	target  int64          // the gen of an evaluation to interrupt
+	thread  unsafe.Pointer // the worker's PRThread, see Close
+	closed  chan bool      // closed by Close to stop the worker
+	exited  chan bool      // closed when the worker stops using the Context
 }
 
+// ErrContextDestroyed is returned when a Context is used after Destroy.
+var ErrContextDestroyed = errors.New("attempt to use a destroyed context")
+
 // Create a context to execute javascript in.
+// Panics if the context cannot be created, see NewContextE.
 func NewContext() *Context {
+	cx, err := NewContextE()
+	if err != nil {
+		panic(err)
+	}
+	return cx
+}
+
+// NewContextE is like NewContext but returns an error if the context's
+// worker fails to start.
+func NewContextE() (*Context, error) {
+	return NewContextWithOptions(Options{})
+}
+
+// NewContextWithOptions creates a context configured by opts, returning
+// an error if the worker fails to start.
+func NewContextWithOptions(opts Options) (*Context, error) {
 	cx := &Context{}
 	cx.id = uid()
 	cx.ready = make(chan error, 1)
+	cx.closed = make(chan bool)
+	cx.exited = make(chan bool)
 	cx.in = make(chan *cxfn)
 	cx.objs = make(map[int]*Object)
 	cx.funcs = make(map[int]*function)
+	cx.codec = newCodec()
+	var flags C.int
+	if opts.DisableEval {
+		flags |= C.JSAPI_NO_EVAL
+	}
+	var globals *C.char
+	if opts.Globals != nil {
+		for _, name := range opts.Globals {
+			if !isIdent(name) {
+				return nil, fmt.Errorf("invalid global name %q", name)
+			}
+		}
+		globals = C.CString(strings.Join(opts.Globals, ","))
+		defer C.free(unsafe.Pointer(globals))
+	}
 	var err error
+	// registered first as the worker looks itself up on start
+	contexts.add(cx)
 	jsapi.do(func() {
-		if C.JSAPI_NewContext(C.int(cx.id)) != C.JSAPI_OK {
+		if C.JSAPI_NewContext(C.int(cx.id), flags, globals, &cx.thread) != C.JSAPI_OK {
 			err = fmt.Errorf("failed to spawn new context")
-			return
 		}
-		contexts[cx.id] = cx
 	})
 	if err != nil {
-		panic(err)
+		contexts.remove(cx.id)
+		return nil, err
 	}
 	err = <-cx.ready
 	if err != nil {
-		panic(err)
+		cx.release()
+		return nil, err
 	}
-	cx.Valid = true
+	atomic.StoreInt32(&cx.valid, 1)
 	runtime.SetFinalizer(cx, finalizer)
-	cx.do(func(ptr *C.JSAPIContext) {
-		cx.ptr = ptr
-	})
-	return cx
+	return cx, nil
+}
+
+// frame holds the error of a single evaluation. Evaluations nest when a
+// Go function called from javascript evaluates more javascript, each
+// gets its own frame so errors cannot leak between them.
+type frame struct {
+	err    *ErrorReport
+	panic  *PanicError         // first Go panic recovered during the evaluation
+	quota  *QuotaExceeded      // first quota exceeded during the evaluation
+	quotas map[*limiter]*usage // quota usage, counted on the outermost frame
+	stop   error               // why the evaluation was terminated, see Budget
+}
+
+// push starts a frame for a new evaluation and returns a func to end it.
+// Must be called from the Context's worker thread.
+func (cx *Context) push() (*frame, func()) {
+	f := &frame{}
+	if len(cx.frames) == 0 {
+		cx.nextGen()
+	}
+	cx.frames = append(cx.frames, f)
+	return f, func() {
+		cx.frames[len(cx.frames)-1] = nil
+		cx.frames = cx.frames[:len(cx.frames)-1]
+		if len(cx.frames) == 0 {
+			cx.nextGen()
+		}
+	}
+}
+
+// nextGen advances gen at the start and end of a top level evaluation
+func (cx *Context) nextGen() {
+	cx.intrMu.Lock()
+	cx.gen++
+	cx.intrMu.Unlock()
+}
+
+// interrupted reports whether Interrupt was called during the running
+// evaluation
+func (cx *Context) interrupted() bool {
+	cx.intrMu.Lock()
+	defer cx.intrMu.Unlock()
+	return cx.gen%2 == 1 && cx.target == cx.gen
+}
+
+// Interrupt stops the running evaluation, which fails with ErrInterrupted.
+// It may be called from any goroutine and reports whether an evaluation
+// was running. Scripts are stopped at their next loop iteration or
+// function call, a Go function called by the script is not interrupted
+// but the script stops once it returns. Calls queued behind the
+// evaluation run as normal.
+func (cx *Context) Interrupt() bool {
+	cx.intrMu.Lock()
+	defer cx.intrMu.Unlock()
+	if !cx.IsValid() || cx.gen%2 == 0 {
+		return false
+	}
+	cx.target = cx.gen
+	C.JSAPI_RequestInterrupt(cx.ptr)
+	return true
+}
+
+// stop records why the running evaluation is being terminated
+func (cx *Context) stop(err error) {
+	if n := len(cx.frames); n > 0 && cx.frames[n-1].stop == nil {
+		cx.frames[n-1].stop = err
+	}
 }
 
 // The javascript side ends up calling this when an uncaught
-// exception manages to bubble to the top.
-func (cx *Context) setError(filename string, line uint, message string) {
-	cx.err = &ErrorReport{
-		Filename: filename,
-		Line:     line,
-		Message:  message,
+// exception manages to bubble to the top of an evaluation.
+func (cx *Context) setError(r *ErrorReport) {
+	if len(cx.frames) == 0 {
+		return
 	}
+	cx.frames[len(cx.frames)-1].err = r
 }
 
-// fetch an error for an eval filename and remove it from the pile
-func (cx *Context) getError(filename string) (err error) {
-	err = cx.err
-	cx.err = nil
-	return err
+// warn passes a warning to the OnWarning hook if there is one
+func (cx *Context) warn(r *ErrorReport) {
+	cx.hookMu.Lock()
+	fn := cx.onWarn
+	cx.hookMu.Unlock()
+	if fn != nil {
+		fn(r)
+	}
+}
+
+// OnWarning sets fn to be called with warnings raised by javascript, such
+// as strict mode and deprecation warnings, which are otherwise ignored.
+// Setting a hook enables these extra warnings, passing nil disables them.
+// fn is called on the Context's worker thread during evaluation.
+func (cx *Context) OnWarning(fn func(*ErrorReport)) error {
+	cx.hookMu.Lock()
+	cx.onWarn = fn
+	cx.hookMu.Unlock()
+	var enabled C.int
+	if fn != nil {
+		enabled = 1
+	}
+	return cx.do(func(ptr *C.JSAPIContext) {
+		C.JSAPI_SetExtraWarnings(ptr, enabled)
+	})
+}
+
+// jsName converts an exported Go name to its javascript form
+func jsName(name string) string {
+	return strings.ToLower(name[0:1]) + name[1:]
+}
+
+// error returns the error raised during the frame's evaluation
+func (f *frame) error(filename string) error {
+	if f.stop != nil {
+		return f.stop
+	}
+	if f.err == nil {
+		if f.panic != nil {
+			return f.panic
+		}
+		return fmt.Errorf("%s: evaluation failed without an error report", filename)
+	}
+	f.err.Panic = f.panic
+	f.err.Quota = f.quota
+	return f.err
+}
+
+// IsValid reports whether the context is usable, ie. it has not been
+// destroyed.
+func (cx *Context) IsValid() bool {
+	return atomic.LoadInt32(&cx.valid) == 1
 }
 
 // Teardown the context. It is an error to use a context after
-// it is destroyed.
+// it is destroyed. See Close.
 func (cx *Context) Destroy() {
-	if cx.Valid {
-		close(cx.in)
-		cx.Valid = false
+	cx.Close()
+}
+
+// Close tears down the context, waiting for its worker thread to exit and
+// its javascript runtime to be freed. It is an error to use a context
+// after it is closed, closing it again does nothing. If called from
+// within the context (eg. by a Go function) the teardown completes in the
+// background once the current evaluation returns.
+func (cx *Context) Close() error {
+	if !atomic.CompareAndSwapInt32(&cx.valid, 1, 0) {
+		return nil
 	}
+	runtime.SetFinalizer(cx, nil)
+	inWorker := cx.ptr != nil && C.JSAPI_ThreadCanAccessContext(cx.ptr) == C.JSAPI_OK
+	close(cx.closed)
+	if inWorker {
+		go cx.release()
+		return nil
+	}
+	return cx.release()
+}
+
+// release joins the worker thread and drops everything held by the
+// context once the worker has exited
+func (cx *Context) release() (err error) {
+	<-cx.exited
+	if C.JSAPI_JoinContext(cx.thread) != C.JSAPI_OK {
+		err = fmt.Errorf("failed to join context worker thread")
+	}
+	contexts.remove(cx.id)
+	cx.thread = nil
+	cx.objs = nil
+	cx.funcs = nil
+	return err
 }
 
 // Execute javascript source in Context and discard any response
 func (cx *Context) Exec(source string) (err error) {
-	return cx.exec(source, "exec")
+	return cx.exec(nil, source, "exec")
 }
 
-func (cx *Context) exec(source string, filename string) (err error) {
-	cx.do(func(ptr *C.JSAPIContext) {
+// ExecContext is like Exec but makes ctx available to any Go functions
+// called by the script that declare a leading context.Context parameter.
+// If ctx is already done when called the script is not run at all.
+func (cx *Context) ExecContext(ctx context.Context, source string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return cx.exec(ctx, source, "exec")
+}
+
+// evaluate runs fn in a new frame on the worker thread, then re-panics
+// according to the panic policy. A non-nil bgt limits the operations
+// performed by fn.
+func (cx *Context) evaluate(ctx context.Context, bgt *budget, fn func(ptr *C.JSAPIContext, f *frame)) error {
+	var f *frame
+	err := cx.do(func(ptr *C.JSAPIContext) {
+		defer cx.enter(ctx)()
+		var pop func()
+		f, pop = cx.push()
+		defer pop()
+		if bgt != nil {
+			bgt.parent = cx.budget
+			cx.budget = bgt
+			defer func() { cx.budget = bgt.parent }()
+			C.JSAPI_RequestInterrupt(ptr)
+		}
+		fn(ptr, f)
+	})
+	if err != nil {
+		return err
+	}
+	cx.repanic(f)
+	return nil
+}
+
+func (cx *Context) exec(ctx context.Context, source string, filename string) (err error) {
+	derr := cx.evaluate(ctx, nil, func(ptr *C.JSAPIContext, f *frame) {
 		csource := C.CString(source)
 		defer C.free(unsafe.Pointer(csource))
 		cfilename := C.CString(filename)
 		defer C.free(unsafe.Pointer(cfilename))
 		// eval
 		if C.JSAPI_Eval(ptr, csource, cfilename) != C.JSAPI_OK {
-			err = cx.getError(filename)
+			err = f.error(filename)
 			return
 		}
 	})
+	if derr != nil {
+		return derr
+	}
 	return err
 }
 
 // Execute javascript source in Context and scan the response into result.
 // Scanning follows the rules of json.Unmarshal so most go native types are
 // supported and complex javascript objects can be scanned by referancing structs.
+// Javascript Dates scan into time.Time, Maps into Go maps (keys of any type)
+// and Sets into slices or map[T]struct{}.
 // The special jsapi.Raw string type can be used if you just the output as a JSON
 // string.
 func (cx *Context) Eval(source string, result interface{}) (err error) {
-	cx.do(func(ptr *C.JSAPIContext) {
+	return cx.eval(nil, source, result)
+}
+
+// EvalContext is like Eval but makes ctx available to any Go functions
+// called by the script that declare a leading context.Context parameter.
+// If ctx is already done when called the script is not run at all.
+func (cx *Context) EvalContext(ctx context.Context, source string, result interface{}) (err error) {
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return cx.eval(ctx, source, result)
+}
+
+func (cx *Context) eval(ctx context.Context, source string, result interface{}) (err error) {
+	// Raw results want plain JSON rather than tagged Dates/Maps/Sets
+	_, raw := result.(*Raw)
+	b, err := cx.evalJSON(ctx, nil, source, !raw)
+	if err != nil {
+		return err
+	}
+	// convert to go
+	return cx.codec.unmarshal(b, result)
+}
+
+// evalJSON executes source within bgt, if not nil, and returns the JSON
+// form of the result
+func (cx *Context) evalJSON(ctx context.Context, bgt *budget, source string, tagged bool) (b []byte, err error) {
+	derr := cx.evaluate(ctx, bgt, func(ptr *C.JSAPIContext, f *frame) {
 		// alloc C-string
 		csource := C.CString(source)
 		defer C.free(unsafe.Pointer(csource))
@@ -351,21 +737,57 @@ func (cx *Context) Eval(source string, result interface{}) (err error) {
 		filename := "eval"
 		cfilename := C.CString(filename)
 		defer C.free(unsafe.Pointer(cfilename))
+		var ctagged C.int
+		if tagged {
+			ctagged = 1
+		}
 		// eval
-		if C.JSAPI_EvalJSON(ptr, csource, cfilename, &jsonData, &jsonLen) != C.JSAPI_OK {
-			err = cx.getError(filename)
+		if C.JSAPI_EvalJSON(ptr, csource, cfilename, ctagged, &jsonData, &jsonLen) != C.JSAPI_OK {
+			err = f.error(filename)
 			return
 		}
 		defer C.free(unsafe.Pointer(jsonData))
-		// convert to go
-		b := []byte(C.GoStringN(jsonData, jsonLen))
-		if raw, ok := result.(*Raw); ok {
-			*raw = Raw(string(b))
-		} else {
-			err = json.Unmarshal(b, result)
-		}
+		b = []byte(C.GoStringN(jsonData, jsonLen))
 	})
-	return err
+	if derr != nil {
+		return nil, derr
+	}
+	return b, err
+}
+
+// Call the javascript function at the path fn (eg. "app.handlers.onLoad")
+// with args and scan the returned value into result (which may be nil to
+// discard it). The function is called with the object it belongs to as this.
+// Arguments are converted in the same way as return values of Go functions.
+func (cx *Context) Call(fn string, result interface{}, args ...interface{}) (err error) {
+	source, err := cx.codec.callSource(fn, args)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return cx.exec(nil, source, "call")
+	}
+	return cx.eval(nil, source, result)
+}
+
+// Implement makes v, a pointer to an interface or struct of funcs, call
+// the methods of the javascript object at path (eg. "plugins.myValidator").
+// Exceptions thrown are returned as *ErrorReport errors.
+//
+// Go cannot construct implementations of an interface at runtime, so when v
+// points to an interface impl must be a struct of funcs (see Bind) with
+// methods that forward to them. A new impl is bound to path and stored in
+// v. impl is only used for its type and may be nil when v points to a
+// struct. An untagged field XFunc calls the javascript method named after
+// the interface's method X, so ValidateFunc below calls validate.
+//
+//	type jsValidator struct { ValidateFunc func(Doc) error }
+//	func (v *jsValidator) Validate(d Doc) error { return v.ValidateFunc(d) }
+//
+//	var v Validator
+//	err := cx.Implement(&v, "plugins.myValidator", jsValidator{})
+func (cx *Context) Implement(v interface{}, path string, impl interface{}) error {
+	return implement(cx, v, path, impl)
 }
 
 // Execute javascript in the context from an io.Reader.
@@ -378,7 +800,7 @@ func (cx *Context) execFrom(r io.Reader, filename string) (err error) {
 	if err != nil {
 		return
 	}
-	return cx.exec(string(b), filename)
+	return cx.exec(nil, string(b), filename)
 }
 
 // Execute javascript in the context from a file
@@ -391,13 +813,92 @@ func (cx *Context) ExecFile(filename string) (err error) {
 	return cx.execFrom(f, filename)
 }
 
+// Execute the javascript files in fsys matching pattern (see fs.Glob) in
+// lexical order, stopping at the first error. Errors report the path of
+// the file within fsys.
+//
+//	//go:embed js
+//	var bundle embed.FS
+//	cx.ExecFS(bundle, "js/*.js")
+func (cx *Context) ExecFS(fsys fs.FS, pattern string) error {
+	scripts, err := readFS(fsys, pattern)
+	if err != nil {
+		return err
+	}
+	return cx.execScripts(scripts)
+}
+
+// sourceFile is javascript source read ahead of execution
+type sourceFile struct {
+	filename string
+	source   string
+}
+
+// readFS reads the files in fsys matching pattern in lexical order
+func readFS(fsys fs.FS, pattern string) ([]sourceFile, error) {
+	names, err := fs.Glob(fsys, pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no files match %s", pattern)
+	}
+	sort.Strings(names)
+	scripts := make([]sourceFile, len(names))
+	for i, name := range names {
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		scripts[i] = sourceFile{name, string(b)}
+	}
+	return scripts, nil
+}
+
+func (cx *Context) execScripts(scripts []sourceFile) error {
+	for _, s := range scripts {
+		if err := cx.exec(nil, s.source, s.filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Define a javascript object in the Context.
 // If proxy is nil, then an empty js object is created.
 // If proxy references a struct type, then a two-way binding of all public
 // fields within proxy the proxy object will be exposed to js via the
 // created object.
 func (cx *Context) DefineObject(name string, proxy interface{}) (Definer, error) {
-	return cx.defineObject(name, proxy, 0)
+	o, err := cx.defineObject(name, proxy, 0)
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// synchronized is a proxy whose properties are guarded by a lock
+type synchronized struct {
+	proxy interface{}
+	mu    sync.Locker
+}
+
+// Synchronized wraps proxy so that javascript reads and writes of its
+// properties hold mu, for use with DefineObject when the same proxy is
+// shared between Contexts (as Pool.DefineObject does) and so may be
+// accessed from several worker threads at once:
+//
+//	var mu sync.Mutex
+//	p.DefineObject("config", jsapi.Synchronized(cfg, &mu))
+//
+// Go code touching the proxy while the Contexts are running should hold
+// mu as well. If mu is nil a new mutex is used. Functions defined on the
+// object are not guarded and must do their own locking.
+func Synchronized(proxy interface{}, mu sync.Locker) interface{} {
+	if mu == nil {
+		mu = new(sync.Mutex)
+	}
+	return &synchronized{proxy, mu}
 }
 
 func (cx *Context) defineObject(name string, proxy interface{}, id int) (o *Object, err error) {
@@ -405,13 +906,17 @@ func (cx *Context) defineObject(name string, proxy interface{}, id int) (o *Obje
 	o.props = make(map[string]*prop)
 	o.cx = cx
 	o.id = uid()
-	cx.do(func(ptr *C.JSAPIContext) {
+	derr := cx.do(func(ptr *C.JSAPIContext) {
 		cname := C.CString(name)
 		defer C.free(unsafe.Pointer(cname))
 		if C.JSAPI_DefineObject(ptr, C.uint32_t(id), cname, C.uint32_t(o.id)) != C.JSAPI_OK {
 			err = fmt.Errorf("failed to define object")
 			return
 		}
+		var mu sync.Locker
+		if s, ok := proxy.(*synchronized); ok {
+			proxy, mu = s.proxy, s.mu
+		}
 		if proxy != nil {
 			o.proxy = proxy
 			ov := reflect.ValueOf(proxy)
@@ -430,8 +935,8 @@ func (cx *Context) defineObject(name string, proxy interface{}, id int) (o *Obje
 				if f.PkgPath != "" {
 					continue
 				}
-				name := strings.ToLower(f.Name[0:1]) + f.Name[1:(len(f.Name))]
-				o.props[name] = &prop{name, fv, f.Type}
+				name := jsName(f.Name)
+				o.props[name] = &prop{name, fv, f.Type, cx, mu}
 				cpropname := C.CString(name)
 				defer C.free(unsafe.Pointer(cpropname))
 				if C.JSAPI_DefineProperty(ptr, C.uint32_t(o.id), cpropname) != C.JSAPI_OK {
@@ -442,6 +947,9 @@ func (cx *Context) defineObject(name string, proxy interface{}, id int) (o *Obje
 		}
 		cx.objs[o.id] = o
 	})
+	if derr != nil {
+		return nil, derr
+	}
 	return
 }
 
@@ -452,6 +960,7 @@ func (cx *Context) DefineFunction(name string, fun interface{}) error {
 func (cx *Context) defineFunction(name string, fun interface{}, parent int) (err error) {
 	f := &function{}
 	f.id = uid()
+	f.cx = cx
 	f.v = reflect.ValueOf(fun)
 	if !f.v.IsValid() {
 		return fmt.Errorf("invalid function type")
@@ -460,8 +969,14 @@ func (cx *Context) defineFunction(name string, fun interface{}, parent int) (err
 	if f.t.Kind() != reflect.Func {
 		return fmt.Errorf("not a valid function type")
 	}
+	for f.skip < f.t.NumIn() && !(f.t.IsVariadic() && f.skip == f.t.NumIn()-1) {
+		if in := f.t.In(f.skip); in != contextType && in != contextPtrType {
+			break
+		}
+		f.skip++
+	}
 	f.name = "[anon]"
-	cx.do(func(ptr *C.JSAPIContext) {
+	derr := cx.do(func(ptr *C.JSAPIContext) {
 		cname := C.CString(name)
 		defer C.free(unsafe.Pointer(cname))
 		if C.JSAPI_DefineFunction(ptr, C.uint32_t(parent), cname, C.uint32_t(f.id)) != C.JSAPI_OK {
@@ -471,25 +986,102 @@ func (cx *Context) defineFunction(name string, fun interface{}, parent int) (err
 		f.name = name
 		cx.funcs[f.id] = f
 	})
+	if derr != nil {
+		return derr
+	}
 	return
 }
 
+// threadTime returns the CPU time used by the calling OS thread. Go
+// functions called from javascript run locked to the worker thread, see
+// enterQuota.
+func threadTime() time.Duration {
+	var ts C.struct_timespec
+	if C.clock_gettime(C.CLOCK_THREAD_CPUTIME_ID, &ts) != 0 {
+		return 0
+	}
+	return time.Duration(ts.tv_sec)*time.Second + time.Duration(ts.tv_nsec)
+}
+
+// HeapSize returns the number of bytes currently allocated in the
+// Context's javascript heap.
+func (cx *Context) HeapSize() (n int, err error) {
+	err = cx.do(func(ptr *C.JSAPIContext) {
+		n = int(C.JSAPI_HeapBytes(ptr))
+	})
+	return n, err
+}
+
+// RegisterConverter customises how values of type t are passed between
+// Go and javascript wherever they appear: function arguments and return
+// values, proxy object properties and Eval results.
+// to converts a Go value of type t into a value that can be passed to
+// javascript (e.g. a string or map[string]interface{}), from converts a
+// javascript value (see JSUnmarshaler) into a value of type t.
+// Either may be nil to keep the default behaviour for that direction.
+// Registered converters take precedence over JSMarshaler and JSUnmarshaler.
+func (cx *Context) RegisterConverter(t reflect.Type, to, from func(interface{}) (interface{}, error)) error {
+	return cx.codec.register(t, to, from)
+}
+
+// SetStrict enables or disables strict conversion of javascript values.
+// In strict mode numbers that would lose precision when converted to a
+// Go integer type (1.5 or 1e20 to an int32 for example) are rejected
+// with a TypeError instead of being truncated.
+func (cx *Context) SetStrict(strict bool) {
+	cx.codec.setStrict(strict)
+}
+
+// SetNativeMaps makes Go maps with non-string keys arrive in javascript as
+// Map objects and maps of struct{} as Set objects. By default all Go maps
+// become plain objects with keys converted as encoding/json would.
+func (cx *Context) SetNativeMaps(enabled bool) {
+	cx.codec.setNativeMaps(enabled)
+}
+
+// enter sets the context.Context for an evaluation and returns a func
+// to restore the previous one. A nil ctx inherits that of any enclosing
+// evaluation (eg. an Eval made from within a Go function).
+// Must be called from the Context's worker thread.
+func (cx *Context) enter(ctx context.Context) func() {
+	prev := cx.ctx
+	if ctx != nil {
+		cx.ctx = ctx
+	}
+	return func() {
+		cx.ctx = prev
+	}
+}
+
+// current returns the context.Context of the running evaluation
+func (cx *Context) current() context.Context {
+	if cx.ctx == nil {
+		return context.Background()
+	}
+	return cx.ctx
+}
+
 // Attempt to aquire mutex, then runs in primary thread.
-// panics if Context is invalid
-func (cx *Context) do(callback func(*C.JSAPIContext)) {
-	if !cx.Valid {
-		panic("attempt to use a destroyed context")
+// Returns ErrContextDestroyed if Context is invalid
+func (cx *Context) do(callback func(*C.JSAPIContext)) error {
+	if !cx.IsValid() {
+		return ErrContextDestroyed
 	}
 	if cx.ptr != nil && C.JSAPI_ThreadCanAccessContext(cx.ptr) == C.JSAPI_OK {
 		callback(cx.ptr)
-		return
+		return nil
 	}
 	fn := &cxfn{
 		call: callback,
 		done: make(chan bool, 1),
 	}
-	cx.in <- fn
+	select {
+	case cx.in <- fn:
+	case <-cx.closed:
+		return ErrContextDestroyed
+	}
 	<-fn.done
+	return nil
 }
 
 type Object struct {
@@ -507,20 +1099,27 @@ func (o *Object) DefineObject(name string, proxy interface{}) (Definer, error) {
 	return o.cx.defineObject(name, proxy, o.id)
 }
 
+var (
+	contextType    = reflect.TypeOf((*context.Context)(nil)).Elem()
+	contextPtrType = reflect.TypeOf((*Context)(nil))
+)
+
+// function is a Go func exposed to javascript. Leading context.Context
+// and *Context params are not javascript arguments, they are populated
+// with the context of the calling evaluation and the Context itself.
 type function struct {
 	id   int
 	name string
 	v    reflect.Value
 	t    reflect.Type
+	cx   *Context
+	skip int // number of leading injected params
 }
 
 func (f *function) call(in string) (out string, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = fmt.Errorf("%s: %v", f.name, r)
-		}
-	}()
-	return f.rawcall(in)
+	return f.cx.guard(f.name, func() (string, error) {
+		return f.rawcall(in)
+	})
 }
 
 func (f *function) rawcall(in string) (out string, err error) {
@@ -530,24 +1129,39 @@ func (f *function) rawcall(in string) (out string, err error) {
 	if err != nil {
 		return
 	}
+	for i := range inargs {
+		if inargs[i], err = revive(inargs[i]); err != nil {
+			return
+		}
+	}
 	// validate args
-	if len(inargs) != f.t.NumIn() && !f.t.IsVariadic() {
-		return "", fmt.Errorf("Invalid number of arguments: expected %d got %d", f.t.NumIn(), len(inargs))
+	min, max := f.arity()
+	if len(inargs) < min || (max >= 0 && len(inargs) > max) {
+		return "", f.argcError(min, max, len(inargs))
 	}
-	invals := make([]reflect.Value, len(inargs))
-	for i := 0; i < len(inargs); i++ {
-		v := reflect.ValueOf(inargs[i])
-		var t reflect.Type
-		if f.t.IsVariadic() && i >= f.t.NumIn()-1 { // handle varargs
-			t = f.t.In(f.t.NumIn() - 1).Elem()
+	invals := make([]reflect.Value, f.skip, f.skip+len(inargs))
+	for i := 0; i < f.skip; i++ {
+		if f.t.In(i) == contextType {
+			invals[i] = reflect.ValueOf(f.cx.current())
 		} else {
-			t = f.t.In(i)
+			invals[i] = reflect.ValueOf(f.cx)
 		}
-		v, err = cast(v, t)
+	}
+	for i := 0; i < len(inargs); i++ {
+		t := f.argType(i)
+		v, err := f.cx.codec.cast(inargs[i], t)
 		if err != nil {
-			return
+			return "", f.argError(i, t, inargs[i], err)
 		}
-		invals[i] = v
+		invals = append(invals, v)
+	}
+	// missing optional args are nil
+	nfixed := f.t.NumIn()
+	if f.t.IsVariadic() {
+		nfixed--
+	}
+	for i := len(invals); i < nfixed; i++ {
+		invals = append(invals, reflect.Zero(f.t.In(i)))
 	}
 	// call func
 	outvals := f.v.Call(invals)
@@ -557,51 +1171,55 @@ func (f *function) rawcall(in string) (out string, err error) {
 	if len(outvals) == 0 {
 		return "", nil
 	}
-	outv := outvals[0].Interface()
-	if raw, ok := outv.(Raw); ok {
-		return string(raw), nil
-	}
-	b, err := json.Marshal(outv)
-	return string(b), err
-}
-
-// try to convert v to something that is assignable to type t
-func cast(v reflect.Value, t reflect.Type) (reflect.Value, error) {
-	if v.Type().Kind() == reflect.Ptr && t.Kind() != reflect.Ptr {
-		v = v.Elem()
-	}
-	if !v.Type().AssignableTo(t) {
-		if !v.Type().ConvertibleTo(t) {
-			// A common failure here is that we want to
-			// cast a map[string]interface{} -> struct.
-			// This is obviously not possible, but since it is *known*
-			// that the source and target can both be serialized to
-			// JSON, we can do a nasty hack to fix it
-			// TODO: find a better way!
-			if (t.Kind() == reflect.Ptr || t.Kind() == reflect.Struct) && v.Type().Kind() == reflect.Map {
-				b, err := json.Marshal(v.Interface())
-				if err != nil {
-					return v, fmt.Errorf("cannot cast %s to %s: %s", v.Type().Kind(), t.Kind(), err.Error())
-				}
-				vt := t
-				if vt.Kind() == reflect.Ptr {
-					vt = t.Elem()
-				}
-				vv := reflect.New(vt)
-				err = json.Unmarshal(b, vv.Interface())
-				if err != nil {
-					return v, fmt.Errorf("cannot cast %s to %s: %s", v.Type().Kind(), t.Kind(), err.Error())
-				}
-				if t.Kind() != reflect.Ptr && vv.Type().Kind() == reflect.Ptr {
-					vv = vv.Elem()
-				}
-				return vv, nil
-			}
-			return v, fmt.Errorf("cannot cast %s to %s", v.Type().Kind(), t.Kind())
-		}
-		v = v.Convert(t)
+	return f.cx.codec.marshal(outvals[0].Interface())
+}
+
+// arity returns the minimum and maximum number of javascript arguments
+// the function accepts. Trailing pointer params are optional and max is
+// -1 for variadic functions.
+func (f *function) arity() (min int, max int) {
+	max = f.t.NumIn() - f.skip
+	if f.t.IsVariadic() {
+		max--
+	}
+	min = max
+	for min > 0 && f.t.In(f.skip+min-1).Kind() == reflect.Ptr {
+		min--
+	}
+	if f.t.IsVariadic() {
+		max = -1
 	}
-	return v, nil
+	return
+}
+
+// argType returns the type of the i'th javascript argument
+func (f *function) argType(i int) reflect.Type {
+	i += f.skip
+	if f.t.IsVariadic() && i >= f.t.NumIn()-1 { // handle varargs
+		return f.t.In(f.t.NumIn() - 1).Elem()
+	}
+	return f.t.In(i)
+}
+
+func (f *function) argcError(min, max, got int) error {
+	var expected string
+	switch {
+	case max < 0:
+		expected = fmt.Sprintf("at least %d", min)
+	case min == max:
+		expected = fmt.Sprintf("%d", min)
+	default:
+		expected = fmt.Sprintf("%d to %d", min, max)
+	}
+	return &typeError{fmt.Sprintf("%s: expected %s arguments but got %d", f.name, expected, got)}
+}
+
+func (f *function) argError(i int, t reflect.Type, x interface{}, err error) error {
+	expected, actual := f.cx.codec.typeName(t), kindOf(x)
+	if expected == actual { // the problem is further down
+		return &typeError{fmt.Sprintf("%s: argument %d: %s", f.name, i+1, err.Error())}
+	}
+	return &typeError{fmt.Sprintf("%s: argument %d: expected %s but got %s", f.name, i+1, expected, actual)}
 }
 
 // prop is a wrapper around a struct's field's refelction
@@ -609,12 +1227,17 @@ type prop struct {
 	name string
 	v    reflect.Value
 	t    reflect.Type
+	cx   *Context
+	mu   sync.Locker // guards v when the proxy is Synchronized
 }
 
 // get json for property
 func (p *prop) get() (string, error) {
-	b, err := json.Marshal(p.v.Interface())
-	return string(b), err
+	if p.mu != nil {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+	}
+	return p.cx.codec.marshal(p.v.Interface())
 }
 
 // set property via json
@@ -624,11 +1247,24 @@ func (p *prop) set(injson string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	xv := reflect.ValueOf(x)
-	xv, err = cast(xv, p.t)
+	if x, err = revive(x); err != nil {
+		return "", err
+	}
+	xv, err := p.cx.codec.cast(x, p.t)
+	if err != nil {
+		expected, actual := p.cx.codec.typeName(p.t), kindOf(x)
+		if expected == actual {
+			return "", &typeError{fmt.Sprintf("%s: %s", p.name, err.Error())}
+		}
+		return "", &typeError{fmt.Sprintf("%s: expected %s but got %s", p.name, expected, actual)}
+	}
 	if !p.v.CanSet() {
 		return "", fmt.Errorf("property %s is not settable", p.name)
 	}
+	if p.mu != nil {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+	}
 	p.v.Set(xv)
-	return p.get()
+	return p.cx.codec.marshal(p.v.Interface())
 }
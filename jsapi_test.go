@@ -1,10 +1,14 @@
 package jsapi
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
 	"runtime"
 	"sync"
 	"testing"
+	"testing/fstest"
 	"time"
 )
 
@@ -24,6 +28,7 @@ func BenchmarkEvalSngl(b *testing.B) {
 
 func TestInterfaces(t *testing.T) {
 	var _ Evaluator = &Context{}
+	var _ Caller = &Context{}
 	var _ Definer = &Context{}
 	var _ Definer = &Object{}
 }
@@ -569,3 +574,420 @@ func TestRawEval(t *testing.T) {
 
 }
 
+func TestArgumentTypeErrors(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	cx.DefineFunction("add", func(a int, b int) int {
+		return a + b
+	})
+
+	var s string
+	err := cx.Eval(`try { add(1, 'two') } catch(e) { (e instanceof TypeError) + ':' + e.message }`, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := "true:add: argument 2: expected number but got string"
+	if s != exp {
+		t.Fatalf(`expected %q but got %q`, exp, s)
+	}
+
+	err = cx.Exec(`add(1)`)
+	if err == nil {
+		t.Fatalf("expected an error to be returned")
+	}
+	r, ok := err.(*ErrorReport)
+	if !ok {
+		t.Fatalf("expected the error to be an ErrorReport but got: %T %v", err, err)
+	}
+	exp = "TypeError: add: expected 2 arguments but got 1"
+	if r.Message != exp {
+		t.Fatalf(`expected error message to be %q but got %q`, exp, r.Message)
+	}
+
+	err = cx.Eval(`TypeError = function(){ return {patched: true} }; try { add(1, 'two') } catch(e) { e.name }`, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "TypeError" {
+		t.Fatalf(`expected a TypeError after TypeError was replaced but got %q`, s)
+	}
+
+}
+
+func TestOptionalArguments(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	cx.DefineFunction("greet", func(name string, greeting *string) string {
+		if greeting == nil {
+			return "hello " + name
+		}
+		return *greeting + " " + name
+	})
+
+	var s string
+	err := cx.Eval(`greet('bob') + '/' + greet('jeff', 'hi')`, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "hello bob/hi jeff" {
+		t.Fatalf(`expected "hello bob/hi jeff" but got %q`, s)
+	}
+
+}
+
+func TestVaridicMinimumArguments(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	cx.DefineFunction("sprintf", func(format string, args ...interface{}) string {
+		return fmt.Sprintf(format, args...)
+	})
+
+	var s string
+	err := cx.Eval(`try { sprintf() } catch(e) { e.message }`, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := "sprintf: expected at least 1 arguments but got 0"
+	if s != exp {
+		t.Fatalf(`expected %q but got %q`, exp, s)
+	}
+
+}
+
+func TestStrictNumberConversion(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	cx.DefineFunction("double", func(n int8) int8 {
+		return n * 2
+	})
+
+	var i int
+	err := cx.Eval(`double(1.5)`, &i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 2 {
+		t.Fatalf("expected double(1.5) to truncate and return 2 but got %d", i)
+	}
+
+	cx.SetStrict(true)
+	for _, src := range []string{`double(1.5)`, `double(300)`} {
+		var ok bool
+		err = cx.Eval(`try { `+src+`; false } catch(e) { e instanceof TypeError }`, &ok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("expected %s to throw a TypeError in strict mode", src)
+		}
+	}
+
+	err = cx.Eval(`double(4)`, &i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 8 {
+		t.Fatalf("expected double(4) to return 8 in strict mode but got %d", i)
+	}
+
+}
+
+func TestFunctionWithContextArgs(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	type key struct{}
+
+	cx.DefineFunction("whoami", func(ctx context.Context, c *Context, n int) string {
+		if c != cx {
+			return "wrong context"
+		}
+		id, _ := ctx.Value(key{}).(string)
+		return fmt.Sprintf("%s/%d", id, n)
+	})
+
+	ctx := context.WithValue(context.Background(), key{}, "req-1")
+	var s string
+	err := cx.EvalContext(ctx, `whoami(1)`, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "req-1/1" {
+		t.Fatalf(`expected whoami(1) to return "req-1/1" but got %q`, s)
+	}
+
+	err = cx.Eval(`whoami(2)`, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "/2" {
+		t.Fatalf(`expected whoami(2) without a context to return "/2" but got %q`, s)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := cx.ExecContext(ctx, `whoami(3)`); err != context.Canceled {
+		t.Fatalf("expected context.Canceled from a cancelled context but got %v", err)
+	}
+
+}
+
+func TestExecFS(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	fsys := fstest.MapFS{
+		"js/b.js":     {Data: []byte(`order.push('b')`)},
+		"js/a.js":     {Data: []byte(`var order = ['a']`)},
+		"js/c.js":     {Data: []byte(`order.push('c')`)},
+		"js/skip.txt": {Data: []byte(`order.push('txt')`)},
+		"bad/x.js":    {Data: []byte("order.push('x');\nnope()")},
+	}
+
+	err := cx.ExecFS(fsys, "js/*.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s string
+	err = cx.Eval(`order.join()`, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "a,b,c" {
+		t.Fatalf("expected files to run in lexical order a,b,c but got %s", s)
+	}
+
+	err = cx.ExecFS(fsys, "bad/*.js")
+	r, ok := err.(*ErrorReport)
+	if !ok {
+		t.Fatalf("expected an ErrorReport but got %T %v", err, err)
+	}
+	if r.Filename != "bad/x.js" || r.Line != 2 {
+		t.Fatalf("expected error at bad/x.js:2 but got %s:%d", r.Filename, r.Line)
+	}
+
+	if err := cx.ExecFS(fsys, "missing/*.js"); err == nil {
+		t.Fatalf("expected an error when no files match")
+	}
+
+}
+
+// osThreads returns the number of threads in the process, or 0 if unknown
+func osThreads() int {
+	entries, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return 0
+	}
+	return len(entries)
+}
+
+func TestContextLeak(t *testing.T) {
+
+	n := 2000
+	if testing.Short() {
+		n = 100
+	}
+
+	before := contexts.len()
+	threads := osThreads()
+	for i := 0; i < n; i++ {
+		cx := NewContext()
+		cx.DefineFunction("f", func() int { return i })
+		if err := cx.Exec(`f()`); err != nil {
+			t.Fatal(err)
+		}
+		if err := cx.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if cx.objs != nil || cx.funcs != nil {
+			t.Fatalf("expected Close to release objects and functions")
+		}
+	}
+
+	if after := contexts.len(); after != before {
+		t.Fatalf("expected %d registered contexts after closing them all but got %d", before, after)
+	}
+	if threads > 0 {
+		if after := osThreads(); after > threads+50 {
+			t.Fatalf("expected worker threads to exit but thread count grew from %d to %d", threads, after)
+		}
+	}
+
+}
+
+func TestDestroyFromFunction(t *testing.T) {
+
+	cx := NewContext()
+	cx.DefineFunction("destroy", func() {
+		cx.Destroy()
+	})
+	if err := cx.Exec(`destroy()`); err != nil {
+		t.Fatal(err)
+	}
+	if cx.IsValid() {
+		t.Fatalf("expected context to be invalid after destroying itself")
+	}
+
+}
+
+func TestNestedErrors(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	var inner error
+	cx.DefineFunction("nested", func() int {
+		inner = cx.Exec(`throw new Error('inner')`)
+		return 1
+	})
+
+	var i int
+	if err := cx.Eval(`nested() + 1`, &i); err != nil {
+		t.Fatalf("expected the outer eval to succeed but got %v", err)
+	}
+	if i != 2 {
+		t.Fatalf("expected nested() + 1 to eval to 2 but got %d", i)
+	}
+	r, ok := inner.(*ErrorReport)
+	if !ok {
+		t.Fatalf("expected the inner error to be an ErrorReport but got: %T %v", inner, inner)
+	}
+	if r.Message != "Error: inner" {
+		t.Fatalf(`expected inner error message to be "Error: inner" but got %q`, r.Message)
+	}
+
+	if err := cx.Exec(`throw new Error('first')`); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if err := cx.Exec(`1`); err != nil {
+		t.Fatalf("expected the previous error not to leak into the next call but got %v", err)
+	}
+
+}
+
+func TestOnWarning(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	var warnings []*ErrorReport
+	cx.OnWarning(func(r *ErrorReport) {
+		warnings = append(warnings, r)
+	})
+
+	if err := cx.Exec(`var a; if (a = 1) {}`); err != nil {
+		t.Fatalf("expected a warning not to fail the exec but got %v", err)
+	}
+	if len(warnings) == 0 {
+		t.Fatalf("expected OnWarning to be called")
+	}
+	if !warnings[0].Warning {
+		t.Fatalf("expected the report to be flagged as a warning")
+	}
+
+	cx.OnWarning(nil)
+	warnings = nil
+	if err := cx.Exec(`var b; if (b = 1) {}`); err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 0 {
+		t.Fatalf("expected no warnings after removing the hook but got %d", len(warnings))
+	}
+
+}
+
+func TestDestroyedContext(t *testing.T) {
+
+	cx, err := NewContextE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cx.Destroy()
+
+	if err := cx.Exec(`1`); err != ErrContextDestroyed {
+		t.Fatalf("expected Exec to return ErrContextDestroyed but got %v", err)
+	}
+	var i int
+	if err := cx.Eval(`1`, &i); err != ErrContextDestroyed {
+		t.Fatalf("expected Eval to return ErrContextDestroyed but got %v", err)
+	}
+	if err := cx.DefineFunction("f", func() {}); err != ErrContextDestroyed {
+		t.Fatalf("expected DefineFunction to return ErrContextDestroyed but got %v", err)
+	}
+	if _, err := cx.DefineObject("o", nil); err != ErrContextDestroyed {
+		t.Fatalf("expected DefineObject to return ErrContextDestroyed but got %v", err)
+	}
+	if _, err := cx.HeapSize(); err != ErrContextDestroyed {
+		t.Fatalf("expected HeapSize to return ErrContextDestroyed but got %v", err)
+	}
+
+}
+
+type explosive struct{}
+
+func (explosive) MarshalJS() (interface{}, error) {
+	panic("boom")
+}
+
+func TestPanicPolicy(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	cx.DefineFunction("raise", func() {
+		panic("BANG")
+	})
+	cx.DefineObject("bomb", &struct{ Fuse explosive }{})
+
+	err := cx.Exec(`raise()`)
+	var pe *PanicError
+	if !errors.As(err, &pe) {
+		t.Fatalf("expected the error to wrap a PanicError but got: %T %v", err, err)
+	}
+	if pe.Value != "BANG" || len(pe.Stack) == 0 {
+		t.Fatalf("expected a PanicError with the panic value and stack but got %v", pe)
+	}
+
+	err = cx.Exec(`bomb.fuse`)
+	if !errors.As(err, &pe) {
+		t.Fatalf("expected getter panic to be a PanicError but got: %T %v", err, err)
+	}
+
+	var hooked []*PanicError
+	cx.OnPanic(func(pe *PanicError) {
+		hooked = append(hooked, pe)
+	})
+	if err := cx.Exec(`try { raise() } catch(e) {}`); err != nil {
+		t.Fatal(err)
+	}
+	if len(hooked) != 1 || hooked[0].Name != "raise" {
+		t.Fatalf("expected OnPanic to be called once for raise but got %v", hooked)
+	}
+
+	cx.SetPanicPolicy(PanicRepanic)
+	func() {
+		defer func() {
+			r := recover()
+			if pe, ok := r.(*PanicError); !ok || pe.Value != "BANG" {
+				t.Errorf("expected to re-panic with the PanicError but got %v", r)
+			}
+		}()
+		cx.Exec(`try { raise() } catch(e) {}`)
+		t.Fatalf("expected Exec to panic")
+	}()
+	var i int
+	if err := cx.Eval(`1`, &i); err != nil || i != 1 {
+		t.Fatalf("expected context to be usable after re-panic but got %v", err)
+	}
+
+}
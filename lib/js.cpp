@@ -72,6 +72,107 @@ using mozilla::PodEqual;
 using mozilla::UniquePtr;
 
 #define OBJECT_ID_KEY "__oid__"
+#define REPLACER_KEY "__jsapi_replacer__"
+#define REVIVER_KEY "__jsapi_reviver__"
+#define PARSE_KEY "__jsapi_parse__"
+#define FREEZE_KEY "__jsapi_freeze__"
+#define ERRORS_KEY "__jsapi_errors__"
+
+// Installs the JSON replacer/reviver pair used for all values passed
+// between js and Go. Values without a native JSON form (Date, Map, Set)
+// are tagged as {"__jsapi__": type, "value": ...} see convert.go.
+// Dates have already been through toJSON by the time the replacer sees
+// them, so the original is read back from the holder's own data property
+// (never via a getter, which would call into Go a second time).
+// The built-ins used are captured up front so that they keep working when
+// globals are removed (see Options.Globals) or replaced by scripts, as are
+// the error constructors used by throwError.
+static const char *bootstrapSource =
+	"(function(global){\n"
+	"  var TAG = '__jsapi__';\n"
+	"  var Date = global.Date, Map = global.Map, Set = global.Set, isNaN = global.isNaN;\n"
+	"  var getOwnPropertyDescriptor = Object.getOwnPropertyDescriptor;\n"
+	"  var getOwnPropertyNames = Object.getOwnPropertyNames, keysOf = Object.keys;\n"
+	"  var isArray = Array.isArray;\n"
+	"  var defineProperty = Object.defineProperty;\n"
+	"  var freeze = Object.freeze, isFrozen = Object.isFrozen;\n"
+	"  var parseJSON = JSON.parse;\n"
+	"  var ESCAPED = /^_+__jsapi__$/, ESCAPABLE = /^_*__jsapi__$/;\n"
+	"  function tag(t, v){ var o = {}; o[TAG] = t; o.value = v; return o; }\n"
+	"  // copies o with keys matching re renamed by fn, or returns o as is\n"
+	"  function rekey(o, re, fn){\n"
+	"    var names = getOwnPropertyNames(o), found = false;\n"
+	"    for( var i = 0; i < names.length; i++ ){\n"
+	"      if( re.test(names[i]) ){ found = true; break; }\n"
+	"    }\n"
+	"    if( !found ){\n"
+	"      return o;\n"
+	"    }\n"
+	"    var copy = {}, keys = keysOf(o);\n"
+	"    for( var i = 0; i < keys.length; i++ ){\n"
+	"      var k = keys[i];\n"
+	"      copy[re.test(k) ? fn(k) : k] = o[k];\n"
+	"    }\n"
+	"    return copy;\n"
+	"  }\n"
+	"  function escape(k){ return '_' + k; }\n"
+	"  function unescape(k){ return k.slice(1); }\n"
+	"  function replacer(k, v){\n"
+	"    if( typeof v === 'string' ){\n"
+	"      var d = getOwnPropertyDescriptor(this, k);\n"
+	"      if( d && d.value instanceof Date ){\n"
+	"        var ms = d.value.getTime();\n"
+	"        return tag('Date', isNaN(ms) ? null : ms);\n"
+	"      }\n"
+	"    }\n"
+	"    if( v instanceof Map ){\n"
+	"      var entries = [];\n"
+	"      v.forEach(function(x, key){ entries.push([key, x]); });\n"
+	"      return tag('Map', entries);\n"
+	"    }\n"
+	"    if( v instanceof Set ){\n"
+	"      var values = [];\n"
+	"      v.forEach(function(x){ values.push(x); });\n"
+	"      return tag('Set', values);\n"
+	"    }\n"
+	"    if( v !== null && typeof v === 'object' && !isArray(v) ){\n"
+	"      return rekey(v, ESCAPABLE, escape);\n"
+	"    }\n"
+	"    return v;\n"
+	"  }\n"
+	"  function reviver(k, v){\n"
+	"    if( v === null || typeof v !== 'object' || isArray(v) ){\n"
+	"      return v;\n"
+	"    }\n"
+	"    if( typeof v[TAG] !== 'string' ){\n"
+	"      return rekey(v, ESCAPED, unescape);\n"
+	"    }\n"
+	"    switch( v[TAG] ){\n"
+	"    case 'Date': return new Date(v.value);\n"
+	"    case 'Map': return new Map(v.value);\n"
+	"    case 'Set': return new Set(v.value);\n"
+	"    }\n"
+	"    return v;\n"
+	"  }\n"
+	"  function parse(s){ return parseJSON(s, reviver); }\n"
+	"  function deepFreeze(o){\n"
+	"    if( o === null || (typeof o !== 'object' && typeof o !== 'function') || isFrozen(o) ){\n"
+	"      return o;\n"
+	"    }\n"
+	"    freeze(o);\n"
+	"    var names = getOwnPropertyNames(o);\n"
+	"    for( var i = 0; i < names.length; i++ ){\n"
+	"      var d = getOwnPropertyDescriptor(o, names[i]);\n"
+	"      if( d && 'value' in d ){ deepFreeze(d.value); }\n"
+	"    }\n"
+	"    return o;\n"
+	"  }\n"
+	"  defineProperty(global, '" REPLACER_KEY "', {value: replacer});\n"
+	"  defineProperty(global, '" REVIVER_KEY "', {value: reviver});\n"
+	"  defineProperty(global, '" PARSE_KEY "', {value: parse});\n"
+	"  defineProperty(global, '" FREEZE_KEY "', {value: deepFreeze});\n"
+	"  defineProperty(global, '" ERRORS_KEY "', {value: freeze({Error: global.Error, TypeError: global.TypeError})});\n"
+	"})(this);\n";
 
 
 /* The class of the global object. */
@@ -89,14 +190,34 @@ static const JSClass global_class = {
 // The error reporter callback.
 void reportError(JSContext *cx, const char *message, JSErrorReport *report) {
 	JSAPIContext *c = (JSAPIContext*)JS_GetContextPrivate(cx);
-	go_error(c, (char*)report->filename, (unsigned int)report->lineno, (char*)message);
+	int warning = JSREPORT_IS_WARNING(report->flags) ? 1 : 0;
+	go_error(c, (char*)report->filename, (unsigned int)report->lineno, (char*)message, warning);
+}
+
+// Reports any exception left pending by a failed evaluation so that it is
+// attributed to that evaluation rather than an enclosing one.
+static void reportPending(JSAPIContext *c){
+	if( JS_IsExceptionPending(c->cx) ){
+		JS_ReportPendingException(c->cx);
+	}
+}
+
+// The interrupt callback, runs on the worker thread at the next loop
+// iteration or function call after JSAPI_RequestInterrupt. Returning
+// false terminates the running script with an uncatchable error.
+static bool interruptCallback(JSContext *cx){
+	JSAPIContext *c = (JSAPIContext*)JS_GetContextPrivate(cx);
+	if( c == NULL ){
+		return true;
+	}
+	return go_interrupt(c) == GO_OK;
 }
 
 // The OOM reporter
 void reportOOM(JSContext *cx, void *data) {
 	JSAPIContext *c = (JSAPIContext*)data;
 	fprintf(stderr, "spidermonkey has run out of memory!\n");
-	go_error(c, "__fatal__", 0, "spidermonkey ran out of memory"); 
+	go_error(c, "__fatal__", 0, "spidermonkey ran out of memory", 0); 
 }
 
 JSObject* idToObj(JSAPIContext* c, uint32_t id){
@@ -185,6 +306,75 @@ bool stringifier(const jschar *s, uint32_t n, void *data){
 	return true;
 }
 
+// Stringify v as JSON into buf. If tagged is true Dates, Maps and Sets
+// are converted to their tagged form via the context's replacer.
+// NOTE: buf->str requires freeing even on failure.
+bool stringify(JSAPIContext *c, MutableHandleValue v, jsonBuffer *buf, bool tagged){
+	buf->str = NULL;
+	buf->cx = c->cx;
+	buf->o = c->o;
+	buf->n = 0;
+	RootedObject global(c->cx, c->o);
+	RootedObject replacer(c->cx);
+	if( tagged ){
+		RootedValue fn(c->cx);
+		if( !JS_GetProperty(c->cx, global, REPLACER_KEY, &fn) || !fn.isObject() ){
+			return false;
+		}
+		replacer = &fn.toObject();
+	}
+	RootedValue undefined(c->cx);
+	return JS_Stringify(c->cx, v, replacer, undefined, stringifier, buf);
+}
+
+// Parse JSON from Go into out, reviving any tagged values.
+bool parse(JSAPIContext *c, char *json, MutableHandleValue out){
+	RootedObject global(c->cx, c->o);
+	RootedValue reviver(c->cx);
+	if( !JS_GetProperty(c->cx, global, REVIVER_KEY, &reviver) ){
+		return false;
+	}
+	RootedString str(c->cx, JS_NewStringCopyZ(c->cx, json));
+	return JS_ParseJSONWithReviver(c->cx, str, reviver, out);
+}
+
+// Throw an error constructed by ctor (Error or TypeError, as captured by
+// the bootstrap) with the given message as the pending exception,
+// overriding its name if name is not NULL. Falls back to a plain error if
+// the error can't be constructed.
+void throwError(JSAPIContext *c, const char *ctor, const char *name, char *msg){
+	RootedObject global(c->cx, c->o);
+	RootedValue errors(c->cx);
+	RootedValue ctorv(c->cx);
+	RootedValue arg(c->cx, STRING_TO_JSVAL(JS_NewStringCopyZ(c->cx, msg)));
+	if( !JS_GetProperty(c->cx, global, ERRORS_KEY, &errors) || !errors.isObject() ){
+		JS_ReportError(c->cx, "%s", msg);
+		return;
+	}
+	RootedObject errorsobj(c->cx, &errors.toObject());
+	if( !JS_GetProperty(c->cx, errorsobj, ctor, &ctorv) || !ctorv.isObject() ){
+		JS_ReportError(c->cx, "%s", msg);
+		return;
+	}
+	RootedObject ctorobj(c->cx, &ctorv.toObject());
+	RootedObject err(c->cx, JS_New(c->cx, ctorobj, HandleValueArray(arg)));
+	if( !err ){
+		JS_ReportError(c->cx, "%s", msg);
+		return;
+	}
+	if( name != NULL ){
+		RootedValue namev(c->cx, STRING_TO_JSVAL(JS_NewStringCopyZ(c->cx, name)));
+		JS_SetProperty(c->cx, err, "name", namev);
+	}
+	RootedValue errv(c->cx, OBJECT_TO_JSVAL(err));
+	JS_SetPendingException(c->cx, errv);
+}
+
+// Throw a TypeError with the given message as the pending exception.
+void throwTypeError(JSAPIContext *c, char *msg){
+	throwError(c, "TypeError", NULL, msg);
+}
+
 bool wrapGoFunction(JSContext *cx, unsigned argc, JS::Value *vp) {
 	JSAPIContext *c = (JSAPIContext*)JS_GetContextPrivate(cx);
 	JSAutoRequest ar(c->cx);
@@ -210,20 +400,14 @@ bool wrapGoFunction(JSContext *cx, unsigned argc, JS::Value *vp) {
 	RootedValue argValues(c->cx, OBJECT_TO_JSVAL(argArray));
 	// convert to json 
 	jsonBuffer buf;
-	buf.str = NULL;
-	buf.cx = c->cx;
-	buf.o = c->o;
-	buf.n = 0;
-	RootedObject replacer(c->cx);
-	RootedValue undefined(c->cx);
-	JS_Stringify(c->cx, &argValues, replacer, undefined, stringifier, &buf);
+	stringify(c, &argValues, &buf, true);
 	// send to go and parse resulting json
 	bool ok = true;
 	char *result = NULL;
-	if( go_callback(c, objId(c, callee), name, buf.str, int(buf.n), &result) ){
+	int status = go_callback(c, objId(c, callee), name, buf.str, int(buf.n), &result);
+	if( status == GO_OK ){
 		if( strlen(result) > 0 ){
-			RootedString resultstr(c->cx, JS_NewStringCopyZ(c->cx, result));
-			if( JS_ParseJSON(c->cx, resultstr, &out) ){
+			if( parse(c, result, &out) ){
 				args.rval().set(out);
 			} else {
 				ok = false;
@@ -231,6 +415,12 @@ bool wrapGoFunction(JSContext *cx, unsigned argc, JS::Value *vp) {
 		} else { // return undefined if no json but healthy response
 			args.rval().setUndefined();
 		}
+	} else if( status == GO_TYPE_ERROR ){
+		ok = false;
+		throwTypeError(c, result);
+	} else if( status == GO_QUOTA_ERROR ){
+		ok = false;
+		throwError(c, "Error", "QuotaExceeded", result);
 	} else {
 		ok = false;
 		JS_ReportError(c->cx, "%s", result);
@@ -281,8 +471,7 @@ bool wrapGoGetter(JSContext *cx,  JS::HandleObject obj, JS::Handle<jsid> propid,
 	RootedValue out(cx);
 	if( go_getter(c, objId(c, obj), idstr.ptr(), &result) ){
 		if( strlen(result) > 0 ){
-			RootedString resultstr(c->cx, JS_NewStringCopyZ(c->cx, result));
-			if( JS_ParseJSON(c->cx, resultstr, &out) ){
+			if( parse(c, result, &out) ){
 				vp.set(out);
 			} else {
 				ok = false;
@@ -311,21 +500,15 @@ bool wrapGoSetter(JSContext *cx,  JS::Handle<JSObject*> obj, JS::Handle<jsid> pr
 	}
 	// convert to json 
 	jsonBuffer buf;
-	buf.str = NULL;
-	buf.cx = c->cx;
-	buf.o = c->o;
-	buf.n = 0;
-	RootedObject replacer(c->cx);
-	RootedValue undefined(c->cx);
-	JS_Stringify(c->cx, vp, replacer, undefined, stringifier, &buf);
+	stringify(c, vp, &buf, true);
 	// call go
 	bool ok = true;
 	char* result = NULL;
 	RootedValue out(cx);
-	if( go_setter(c, objId(c, obj), idstr.ptr(), buf.str, int(buf.n), &result) ){
+	int status = go_setter(c, objId(c, obj), idstr.ptr(), buf.str, int(buf.n), &result);
+	if( status == GO_OK ){
 		if( strlen(result) > 0 ){
-			RootedString resultstr(c->cx, JS_NewStringCopyZ(c->cx, result));
-			if( JS_ParseJSON(c->cx, resultstr, &out) ){
+			if( parse(c, result, &out) ){
 				vp.set(out);
 			} else {
 				ok = false;
@@ -333,6 +516,9 @@ bool wrapGoSetter(JSContext *cx,  JS::Handle<JSObject*> obj, JS::Handle<jsid> pr
 		} else { // return undefined if no json but healthy response
 			vp.setUndefined();
 		}
+	} else if( status == GO_TYPE_ERROR ){
+		ok = false;
+		throwTypeError(c, result);
 	} else {
 		ok = false;
 		JS_ReportError(c->cx, "%s", result);
@@ -399,44 +585,49 @@ jerr JSAPI_ThreadCanAccessContext(JSAPIContext* c) {
 	return JSAPI_OK;
 }
 
+void JSAPI_FreeChar(JSAPIContext *c, char *p){
+	JS_free(c->cx, p);
+}
 
-jerr JSAPI_DestroyContext(JSAPIContext *c){
-	if( c != NULL ){
-		JS_DestroyContext(c->cx);
-		free(c);
-	}
-	return JSAPI_OK;
+// Enables strict mode and deprecation warnings, which are sent to the
+// error reporter flagged as warnings.
+void JSAPI_SetExtraWarnings(JSAPIContext *c, int enabled){
+	JS::ContextOptionsRef(c->cx).setExtraWarnings(enabled != 0);
 }
 
-void JSAPI_FreeChar(JSAPIContext *c, char *p){
-	JS_free(c->cx, p);
+// Asks for the interrupt callback to be run as soon as possible. Unlike
+// the rest of the API this may be called from any thread.
+void JSAPI_RequestInterrupt(JSAPIContext *c){
+	JS_RequestInterruptCallback(c->rt);
+}
+
+// Returns the number of bytes allocated in the context's GC heap.
+uint32_t JSAPI_HeapBytes(JSAPIContext *c){
+	return JS_GetGCParameter(c->rt, JSGC_BYTES);
 }
 
 // Executes javascript source string and returns response as
-// JSON string (outstr).
+// JSON string (outstr). If tagged is non-zero Dates, Maps and
+// Sets are encoded in their tagged form (see bootstrapSource).
 // Returns JSAPI_OK on success.
 // NOTE: outstr requires freeing on success.
-jerr JSAPI_EvalJSON(JSAPIContext *c, char *source, char *filename, char **outstr, int *outlen){
+jerr JSAPI_EvalJSON(JSAPIContext *c, char *source, char *filename, int tagged, char **outstr, int *outlen){
     JSAutoRequest ar(c->cx);
     JSAutoCompartment ac(c->cx, c->o);
     RootedObject global(c->cx, c->o);
 	RootedValue rval(c->cx);
 	// eval
 	if (!JS_EvaluateScript(c->cx, global, source, strlen(source), filename, 1, &rval)) {
+		reportPending(c);
 		return JSAPI_FAIL;
 	}
 	// convert to json 
 	jsonBuffer buf;
-	buf.str = NULL;
-	buf.cx = c->cx;
-	buf.o = c->o;
-	buf.n = 0;
-	RootedObject replacer(c->cx);
-	RootedValue undefined(c->cx);
-	if( !JS_Stringify(c->cx, &rval, replacer, undefined, stringifier, &buf) ){
+	if( !stringify(c, &rval, &buf, tagged != 0) ){
 		if( buf.str != NULL ){
 			free(buf.str);
 		}
+		reportPending(c);
 		return JSAPI_FAIL;
 	}
 	*outstr = buf.str;
@@ -452,6 +643,7 @@ jerr JSAPI_Eval(JSAPIContext *c, char *source, char *filename){
 	RootedValue rval(c->cx);
 	// eval
 	if (!JS_EvaluateScript(c->cx, global, source, strlen(source), filename, 1, &rval)) {
+		reportPending(c);
 		return JSAPI_FAIL;
 	}
 	return JSAPI_OK;
@@ -464,15 +656,133 @@ jerr JSAPI_Eval(JSAPIContext *c, char *source, char *filename){
 struct WorkerInput {
     JSRuntime* runtime;
 	int id;
+	int flags;
+	char *globals; // comma separated whitelist, NULL for all
 
-    WorkerInput(JSRuntime* runtime, int id)
-      : runtime(runtime), id(id)
+    WorkerInput(JSRuntime* runtime, int id, int flags, const char *globals)
+      : runtime(runtime), id(id), flags(flags), globals(globals ? js_strdup(globals) : NULL)
     {}
 
     ~WorkerInput() {
+        js_free(globals);
     }
 };
 
+// The standard classes needed by the bootstrap or by the engine itself to
+// evaluate literals and throw errors, along with the functions defined on
+// the global object when they are created. They are always created, but
+// those not whitelisted are removed from the global object once the
+// bootstrap has captured what it needs. See Options.Globals.
+static const char *internalGlobals[] = {
+	"Object", "Function", "eval", "Array", "String", "Number", "Boolean",
+	"RegExp", "Error", "EvalError", "RangeError", "ReferenceError",
+	"SyntaxError", "TypeError", "URIError", "JSON", "Date", "Map", "Set",
+	"isNaN", "isFinite", "parseInt", "parseFloat", "escape", "unescape",
+	"uneval", "decodeURI", "decodeURIComponent", "encodeURI",
+	"encodeURIComponent", NULL
+};
+
+// The global values every script needs, they cannot be removed
+static const char *valueGlobals[] = {"undefined", "NaN", "Infinity", NULL};
+
+// Reports whether name appears in the comma separated list
+static bool listed(const char *list, const char *name){
+	size_t n = strlen(name);
+	for( const char *p = list; p; p = strchr(p, ',') ){
+		if( *p == ',' ){
+			p++;
+		}
+		if( strncmp(p, name, n) == 0 && (p[n] == ',' || p[n] == '\0') ){
+			return true;
+		}
+	}
+	return false;
+}
+
+// Creates the standard class or global function name on the global object
+// if the engine knows of it. found reports whether it now exists.
+static bool resolveGlobal(JSContext *cx, HandleObject global, const char *name, bool *found){
+	JSString *str = JS_InternString(cx, name);
+	if( !str ){
+		return false;
+	}
+	RootedId id(cx, INTERNED_STRING_TO_JSID(cx, str));
+	bool resolved;
+	if( !JS_ResolveStandardClass(cx, global, id, &resolved) ){
+		return false;
+	}
+	return JS_AlreadyHasOwnPropertyById(cx, global, id, found);
+}
+
+// Creates the standard classes on the global object. With a whitelist only
+// the listed classes and the internal ones are created, in place of
+// JS_InitStandardClasses which creates them all. On failure err holds the
+// reason.
+static bool initGlobals(JSContext *cx, HandleObject global, const char *globals, std::string &err){
+	if( globals == NULL ){
+		if( !JS_InitStandardClasses(cx, global) ){
+			err = "failed to init global classes";
+			return false;
+		}
+		return true;
+	}
+	bool found;
+	for( const char **name = valueGlobals; *name; name++ ){
+		if( !resolveGlobal(cx, global, *name, &found) ){
+			err = std::string("failed to init global ") + *name;
+			return false;
+		}
+	}
+	for( const char **name = internalGlobals; *name; name++ ){
+		if( !resolveGlobal(cx, global, *name, &found) ){
+			err = std::string("failed to init global ") + *name;
+			return false;
+		}
+	}
+	const char *p = globals;
+	while( *p ){
+		const char *end = strchr(p, ',');
+		std::string name = end ? std::string(p, end - p) : std::string(p);
+		if( !resolveGlobal(cx, global, name.c_str(), &found) ){
+			err = "failed to init global " + name;
+			return false;
+		}
+		if( !found ){
+			err = "unknown global " + name;
+			return false;
+		}
+		p = end ? end + 1 : p + name.size();
+	}
+	return true;
+}
+
+// Removes the internal classes that are not whitelisted from the global
+// object, once the bootstrap has run
+static bool removeGlobals(JSContext *cx, HandleObject global, const char *globals){
+	if( globals == NULL ){
+		return true;
+	}
+	for( const char **name = internalGlobals; *name; name++ ){
+		if( !listed(globals, *name) && !JS_DeleteProperty(cx, global, *name) ){
+			return false;
+		}
+	}
+	return true;
+}
+
+// Refuses eval() and new Function(), they throw an EvalError instead.
+static bool denyCodeGeneration(JSContext *cx){
+	return false;
+}
+
+static JSSecurityCallbacks makeNoCodeGeneration(){
+	JSSecurityCallbacks cb = {};
+	cb.contentSecurityPolicyAllows = denyCodeGeneration;
+	return cb;
+}
+
+static const JSSecurityCallbacks noCodeGeneration = makeNoCodeGeneration();
+
 static void ContextWorker(void *arg){
 	bool ok = false;
 	JSAPIContext c;
@@ -485,6 +795,9 @@ static void ContextWorker(void *arg){
 			go_worker_fail(c.id, "failed to make global");
 			break;
 		}
+		if( input->flags & JSAPI_NO_EVAL ){
+			JS_SetSecurityCallbacks(c.rt, &noCodeGeneration);
+		}
 		// new context
 		c.cx = JS_NewContext(c.rt, 8192);
 		if (!c.cx) {
@@ -494,6 +807,7 @@ static void ContextWorker(void *arg){
 		JSAutoRequest ar(c.cx);
 		// error handlers
 		JS_SetErrorReporter(c.cx, reportError);
+		JS_SetInterruptCallback(c.rt, interruptCallback);
 		JS::SetOutOfMemoryCallback(c.rt, reportOOM, &c);
 		// Create the global object
 		c.o = JS_NewGlobalObject(c.cx, &global_class, nullptr, JS::DontFireOnNewGlobalHook);
@@ -503,8 +817,9 @@ static void ContextWorker(void *arg){
 			go_worker_fail(c.id, "failed to make global");
 			break;
 		}
-		if (!JS_InitStandardClasses(c.cx, global)) {
-			go_worker_fail(c.id, "failed to init global classes");
+		std::string err;
+		if (!initGlobals(c.cx, global, input->globals, err)) {
+			go_worker_fail(c.id, (char*)err.c_str());
 			break;
 		}
 		js::SetDefaultObjectForContext(c.cx, global);
@@ -523,6 +838,16 @@ static void ContextWorker(void *arg){
 			go_worker_fail(c.id, "failed to assign global to the objdefs store");
 			break;
 		}
+		// Install JSON replacer/reviver
+		RootedValue rval(c.cx);
+		if (!JS_EvaluateScript(c.cx, global, bootstrapSource, strlen(bootstrapSource), "bootstrap", 1, &rval)) {
+			go_worker_fail(c.id, "failed to bootstrap context");
+			break;
+		}
+		if (!removeGlobals(c.cx, global, input->globals)) {
+			go_worker_fail(c.id, "failed to remove global classes");
+			break;
+		}
 		ok = true;
 	} while(0);
 	// worker thread
@@ -540,20 +865,32 @@ static void ContextWorker(void *arg){
 	return;
 }
 
-Vector<PRThread *, 0, SystemAllocPolicy> workerThreads;
-
-jerr JSAPI_NewContext(int id){
+// Spawns a worker thread for context id. The thread tears down the
+// context's runtime when go_worker_wait returns and must then be joined
+// with JSAPI_JoinContext. globals is a comma separated whitelist of the
+// standard classes to create, or NULL for all of them.
+jerr JSAPI_NewContext(int id, int flags, char *globals, void **thread){
 
-    WorkerInput *input = js_new<WorkerInput>(grt, id);
+    WorkerInput *input = js_new<WorkerInput>(grt, id, flags, globals);
     if (!input) {
         return JSAPI_FAIL;
 	}
 
-    PRThread *thread = PR_CreateThread(PR_USER_THREAD, ContextWorker, input,
+    PRThread *t = PR_CreateThread(PR_USER_THREAD, ContextWorker, input,
                                        PR_PRIORITY_NORMAL, PR_GLOBAL_THREAD, PR_JOINABLE_THREAD, 0);
-    if (!thread || !workerThreads.append(thread)) {
+    if (!t) {
+        js_delete(input);
         return JSAPI_FAIL;
 	}
+    *thread = t;
 
     return JSAPI_OK;
 }
+
+// Waits for a context's worker thread to exit.
+jerr JSAPI_JoinContext(void *thread){
+    if (PR_JoinThread((PRThread *)thread) != PR_SUCCESS) {
+        return JSAPI_FAIL;
+	}
+    return JSAPI_OK;
+}
@@ -22,33 +22,47 @@ typedef struct {
 typedef int jerr;
 
 typedef int (*GoFun)(JSAPIContext* c, uint32_t fid, char* name, char* s, int len, char** result);
-typedef void (*GoErr)(JSAPIContext* c, char* filename, unsigned int line, char* msg);
+typedef void (*GoErr)(JSAPIContext* c, char* filename, unsigned int line, char* msg, int warning);
 typedef int (*GoGet)(JSAPIContext* c, uint32_t oid, char* name, char** result);
 typedef int (*GoSet)(JSAPIContext* c, uint32_t oid, char* name, char* s, int len, char** result);
 typedef void (*GoWorkWait)(int id, JSAPIContext* c);
 typedef void (*GoWorkFail)(int id, char* err);
+typedef int (*GoInterrupt)(JSAPIContext* c);
 
 #define JSAPI_OK 0
 #define JSAPI_FAIL 1
 
+/* return codes for the go callbacks */
+#define GO_FAIL 0
+#define GO_OK 1
+#define GO_TYPE_ERROR 2
+#define GO_QUOTA_ERROR 3
+
+/* flags for JSAPI_NewContext */
+#define JSAPI_NO_EVAL 1
+
 GoFun go_callback;
 GoErr go_error;
 GoGet go_getter;
 GoSet go_setter;
 GoWorkWait go_worker_wait;
 GoWorkFail go_worker_fail;
+GoInterrupt go_interrupt;
 
-jerr JSAPI_NewContext(int cid);
+jerr JSAPI_NewContext(int cid, int flags, char* globals, void** thread);
+jerr JSAPI_JoinContext(void* thread);
 jerr JSAPI_Init();
 jerr JSAPI_ThreadCanAccessRuntime();
 jerr JSAPI_ThreadCanAccessContext(JSAPIContext* c);
-jerr JSAPI_DestroyContext(JSAPIContext* c);
-jerr JSAPI_EvalJSON(JSAPIContext* c, char* source, char* filename, char** outstr, int* outlen);
+jerr JSAPI_EvalJSON(JSAPIContext* c, char* source, char* filename, int tagged, char** outstr, int* outlen);
 jerr JSAPI_Eval(JSAPIContext* c, char* source, char* filename);
 void JSAPI_FreeChar(JSAPIContext* c, char* p);
 jerr JSAPI_DefineFunction(JSAPIContext* c, uint32_t pid, char* name, uint32_t fid);
 jerr JSAPI_DefineProperty(JSAPIContext* c, uint32_t pid, char* name);
 jerr JSAPI_DefineObject(JSAPIContext* c, uint32_t pid, char* name, uint32_t oid);
+uint32_t JSAPI_HeapBytes(JSAPIContext* c);
+void JSAPI_SetExtraWarnings(JSAPIContext* c, int enabled);
+void JSAPI_RequestInterrupt(JSAPIContext* c);
 
 #ifdef __cplusplus
 }
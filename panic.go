@@ -0,0 +1,110 @@
+package jsapi
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// PanicPolicy decides what happens when a Go function, property getter or
+// setter called from javascript panics. See Context.SetPanicPolicy.
+type PanicPolicy int
+
+const (
+	// PanicThrow converts the panic into a javascript exception. If the
+	// script does not catch it the returned *ErrorReport carries the
+	// *PanicError, including the Go stack, as its Panic field.
+	PanicThrow PanicPolicy = iota
+	// PanicRepanic throws a javascript exception to unwind the script and
+	// then re-panics with the *PanicError on the goroutine that started the
+	// evaluation, even if the script caught the exception.
+	PanicRepanic
+	// PanicHook calls the hook set with OnPanic and then throws as with
+	// PanicThrow.
+	PanicHook
+)
+
+// PanicError describes a panic recovered from a Go function, getter or
+// setter called from javascript.
+type PanicError struct {
+	Name  string      // the function or property that panicked
+	Value interface{} // the value passed to panic
+	Stack []byte      // the goroutine's stack at the time of the panic
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Name, e.Value)
+}
+
+// Unwrap returns the panic value if it is an error.
+func (e *PanicError) Unwrap() error {
+	if err, ok := e.Value.(error); ok {
+		return err
+	}
+	return nil
+}
+
+// SetPanicPolicy sets how panics in Go code called from javascript are
+// handled. The default is PanicThrow.
+func (cx *Context) SetPanicPolicy(policy PanicPolicy) {
+	cx.hookMu.Lock()
+	defer cx.hookMu.Unlock()
+	cx.policy = policy
+}
+
+// OnPanic sets the policy to PanicHook with fn as the hook, passing nil
+// restores PanicThrow. fn is called on the Context's worker thread before
+// the exception is thrown so must not block on the Context.
+func (cx *Context) OnPanic(fn func(*PanicError)) {
+	cx.hookMu.Lock()
+	defer cx.hookMu.Unlock()
+	cx.onPanic = fn
+	if fn == nil {
+		cx.policy = PanicThrow
+	} else {
+		cx.policy = PanicHook
+	}
+}
+
+// guard calls fn handling any panic according to the panic policy. The
+// recovered panic is returned as a *PanicError to be thrown to javascript.
+func (cx *Context) guard(name string, fn func() (string, error)) (out string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = cx.recovered(name, r)
+		}
+	}()
+	return fn()
+}
+
+// recovered records a panic against the running evaluation and invokes
+// the OnPanic hook if required. Must be called from the worker thread.
+func (cx *Context) recovered(name string, r interface{}) *PanicError {
+	pe, ok := r.(*PanicError) // re-panicked by a nested evaluation
+	if !ok {
+		pe = &PanicError{Name: name, Value: r, Stack: debug.Stack()}
+	}
+	if n := len(cx.frames); n > 0 && cx.frames[n-1].panic == nil {
+		cx.frames[n-1].panic = pe
+	}
+	cx.hookMu.Lock()
+	policy, hook := cx.policy, cx.onPanic
+	cx.hookMu.Unlock()
+	if policy == PanicHook && hook != nil {
+		hook(pe)
+	}
+	return pe
+}
+
+// repanic panics with the frame's recovered panic, if any, when the
+// policy is PanicRepanic. Called once the evaluation has unwound.
+func (cx *Context) repanic(f *frame) {
+	if f == nil || f.panic == nil {
+		return
+	}
+	cx.hookMu.Lock()
+	policy := cx.policy
+	cx.hookMu.Unlock()
+	if policy == PanicRepanic {
+		panic(f.panic)
+	}
+}
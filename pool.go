@@ -1,15 +1,79 @@
 package jsapi
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// ErrPoolBusy is returned when a call gives up waiting for a free worker,
+// either because its context.Context expired or because the queue of
+// waiting callers is full (see SetMaxQueue).
+var ErrPoolBusy = errors.New("pool busy: no worker available")
+
+// ErrPoolDestroyed is returned when a Pool is used after Destroy.
+var ErrPoolDestroyed = errors.New("attempt to use a pool after it was destroyed")
+
+// PoolOptions configures pool workers and when they are recycled. A worker that
+// crosses any of the limits after a call is destroyed and replaced by a
+// fresh Context set up by replaying the pool's recorded setup calls.
+// Zero values mean no limit.
+type PoolOptions struct {
+	MaxUsesPerWorker int           // calls a worker may serve
+	MaxHeapPerWorker int           // javascript heap size in bytes (see Context.HeapSize)
+	MaxAge           time.Duration // time since the worker was created
+	Context          Options       // configures each worker Context
+}
+
 type pfn struct {
-	call func(cx *Context)
+	call     func(cx *Context) error
+	session  bool // holds the worker for a Session, excluded from ExecTime
+	done     chan bool
+	started  chan bool // closed once a worker claims the call
+	state    int32     // pfnQueued, pfnRunning or pfnCancelled (atomic)
+	priority Priority
+	tenant   string
+	queued   time.Time
+	err      error       // returned by call, see oneContext
+	panic    *PanicError // re-panicked by call, see oneContext
+}
+
+// quit asks a worker to leave the pool unless that would leave fewer than
+// min workers, done is closed once it has decided
+type quit struct {
+	min  int
 	done chan bool
 }
 
+// worker is the pool's handle on a worker goroutine
+type worker struct {
+	pin  chan func(cx *Context) // jobs that must run on this worker, see each
+	gone chan bool              // closed when the worker leaves the pool
+	heap int64                  // last heap size measured, see sampleHeap (atomic)
+}
+
+func newPfn(pr Priority, tenant string, callback func(cx *Context) error) *pfn {
+	if pr < Low || pr >= numPriorities {
+		pr = Normal
+	}
+	return &pfn{
+		call:     callback,
+		done:     make(chan bool, 1),
+		started:  make(chan bool),
+		priority: pr,
+		tenant:   tenant,
+	}
+}
+
 // Pool implements the Evaluator and Definer interfaces but
 // is backed by a pool of contexts rather than just one.
 // Since each context can only run one thread at a time certain
@@ -24,195 +88,998 @@ type pfn struct {
 // the pool and there would be no guarentee that you would see it on the
 // next call to Eval/Exec. For these reason there exists EvalAll and ExecAll
 // functions on Pools, which allow for setting up the entire Pool.
+// When a sequence of calls needs to share state, use Acquire to check out
+// a single worker Context as a Session for the duration.
 //
 // The general workflow for using Pool would be:
 //
-//     // Create a pool
-//     p := NewPool(4)
-//     // Setup the pool
-//     p.ExecAll(`function MyAwesomeApp(){ .... }`)
-//     // Use the workers without causing side effects to the global namespace
-//     for i := 0; i<100; i++ {
-//         go func(){
-//             p.Exec(`MyAwecomeApp(1)`)
-//         }()
-//     }
+//	// Create a pool
+//	p := NewPool(4)
+//	// Setup the pool
+//	p.ExecAll(`function MyAwesomeApp(){ .... }`)
+//	// Use the workers without causing side effects to the global namespace
+//	for i := 0; i<100; i++ {
+//	    go func(){
+//	        p.Exec(`MyAwecomeApp(1)`)
+//	    }()
+//	}
+//
+// Setup calls made on the Pool (DefineFunction, DefineObject, ExecAll,
+// ExecFileAll, RegisterConverter, SetStrict and SetNativeMaps) are recorded
+// and replayed into any worker started later by Resize or Autoscale, so new
+// workers are indistinguishable from the old ones. They, and EvalAll, run
+// in each worker between calls, waiting for a running call or Session to
+// finish, so must not be made from a call or Session on the same pool.
 type Pool struct {
-	cxs   []*Context
-	in    chan *pfn
-	wg    sync.WaitGroup
-	n     int  // readonly pool size
-	Valid bool // is this pool active
+	mu         sync.RWMutex
+	resize     sync.Mutex
+	setupMu    sync.Mutex // serialises setup calls, see all
+	cxs        []*Context
+	workers    map[*Context]*worker // keyed by each worker's current context
+	objMu      sync.Mutex           // guards objects, taken after mu when both are held
+	objects    map[*Context]map[*ObjectPool]*Object
+	setup      []func(cx *Context) error // recorded setup calls
+	sched      *scheduler
+	in         chan *pfn
+	wake       chan bool // nudges the dispatcher when calls are queued
+	expand     chan bool // asks scale for another worker
+	quit       chan quit
+	done       chan bool
+	dispatched chan bool // closed when the dispatcher exits
+	wg         sync.WaitGroup
+	n          int64         // current pool size (atomic, changed with mu held)
+	min        int           // autoscale lower bound
+	max        int64         // autoscale upper bound, 0 when not autoscaling (atomic)
+	idle       time.Duration // autoscale idle timeout
+	waiting    int64         // callers waiting for a worker (atomic)
+	maxQueue   int64         // max waiting callers, 0 for no limit (atomic)
+	rejected   int64         // calls that gave up with ErrPoolBusy (atomic)
+	busy       int64         // workers running a call (atomic)
+	errors     int64         // calls that returned an error (atomic)
+	execs      durations     // time spent running calls
+	waits      durations     // time spent waiting for a worker
+	recycled   int64         // workers replaced due to opts limits (atomic)
+	opts       PoolOptions
+	valid      int32 // 1 until destroyed (atomic)
 }
 
 // NewPool creates a pool of n worker contexts.
 func NewPool(n int) *Pool {
+	return NewPoolWithOptions(n, PoolOptions{})
+}
+
+// NewPoolWithOptions creates a pool of n worker contexts that are
+// recycled according to opts. It panics if a worker fails to start, see
+// NewPoolWithOptionsE.
+func NewPoolWithOptions(n int, opts PoolOptions) *Pool {
+	p, err := NewPoolWithOptionsE(n, opts)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// NewPoolWithOptionsE is like NewPoolWithOptions but returns an error if
+// any worker fails to start.
+func NewPoolWithOptionsE(n int, opts PoolOptions) (*Pool, error) {
+	return newPool(n, opts, nil)
+}
+
+// NewPoolWithInit creates a pool of n worker contexts, calling init to
+// set up each one. Unlike DefineObject on the Pool, which binds the same
+// proxy into every worker, init can give each worker its own state:
+//
+//	p, err := jsapi.NewPoolWithInit(4, func(cx *jsapi.Context) error {
+//		_, err := cx.DefineObject("cache", NewCache())
+//		return err
+//	})
+//
+// If init returns an error for any worker, all the contexts are destroyed
+// and the error is returned. init is also called for workers started later
+// by Resize, Autoscale or recycling.
+func NewPoolWithInit(n int, init func(cx *Context) error) (*Pool, error) {
+	return newPool(n, PoolOptions{}, init)
+}
+
+func newPool(n int, opts PoolOptions, init func(cx *Context) error) (*Pool, error) {
 	p := &Pool{}
-	p.cxs = make([]*Context, n)
+	p.opts = opts
+	p.objects = make(map[*Context]map[*ObjectPool]*Object)
+	p.workers = make(map[*Context]*worker)
+	p.sched = newScheduler()
 	p.in = make(chan *pfn)
-	p.n = n
-	p.Valid = true
+	p.wake = make(chan bool, 1)
+	p.expand = make(chan bool, 1)
+	p.quit = make(chan quit)
+	p.done = make(chan bool)
+	p.dispatched = make(chan bool)
+	p.valid = 1
+	go p.dispatch()
+	go p.scale()
+	if init != nil {
+		p.setup = append(p.setup, init)
+	}
 	for i := 0; i < n; i++ {
-		cx := NewContext()
-		p.cxs[i] = cx
+		if err := p.spawn(); err != nil {
+			p.Destroy()
+			p.Wait()
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// spawn starts a new worker. p.mu must not be held.
+func (p *Pool) spawn() error {
+	w := &worker{pin: make(chan func(cx *Context)), gone: make(chan bool)}
+	cx, err := p.newContext(func(cx *Context) {
+		p.cxs = append(p.cxs, cx)
+		p.workers[cx] = w
+		atomic.AddInt64(&p.n, 1)
 		p.wg.Add(1)
-		go func(cx *Context) {
-			for {
-				select {
-				case fn, ok := <-p.in:
-					if !ok {
-						cx.Destroy()
-						p.wg.Done()
-						return
-					}
-					fn.call(cx)
-					fn.done <- true
-				}
+	})
+	if err != nil {
+		return err
+	}
+	go p.work(cx, w)
+	return nil
+}
+
+// newContext creates a context, replays the recorded setup into it and
+// then calls add with p.mu held to put it in the pool. The setup is
+// replayed without p.mu held so that the pool keeps serving calls and
+// setup can call back into it. Steps recorded meanwhile are replayed
+// before add, steps recorded after it are run by all.
+func (p *Pool) newContext(add func(cx *Context)) (*Context, error) {
+	cx, err := NewContextWithOptions(p.opts.Context)
+	if err != nil {
+		return nil, err
+	}
+	p.objMu.Lock()
+	p.objects[cx] = make(map[*ObjectPool]*Object)
+	p.objMu.Unlock()
+	replayed := 0
+	for {
+		p.mu.Lock()
+		if !p.IsValid() {
+			p.forget(cx)
+			p.mu.Unlock()
+			cx.Destroy()
+			return nil, ErrPoolDestroyed
+		}
+		steps := p.setup[replayed:len(p.setup):len(p.setup)]
+		if len(steps) == 0 {
+			add(cx)
+			p.mu.Unlock()
+			return cx, nil
+		}
+		p.mu.Unlock()
+		for _, step := range steps {
+			if err := step(cx); err != nil {
+				p.forget(cx)
+				cx.Destroy()
+				return nil, err
 			}
-		}(cx)
+		}
+		replayed += len(steps)
 	}
-	return p
 }
 
-// Create a go function mapping in ALL contexts within the pool.
-// See context's description for more details.
-func (p *Pool) DefineFunction(name string, fun interface{}) (err error) {
+// recycle replaces cx with a freshly set up context and returns it. If
+// the replacement cannot be set up cx is kept.
+func (p *Pool) recycle(cx *Context) *Context {
+	if !p.IsValid() {
+		return cx
+	}
+	fresh, err := p.newContext(func(fresh *Context) {
+		for i, c := range p.cxs {
+			if c == cx {
+				p.cxs[i] = fresh
+				break
+			}
+		}
+		p.workers[fresh] = p.workers[cx]
+		delete(p.workers, cx)
+		p.forget(cx)
+	})
+	if err != nil {
+		return cx
+	}
+	cx.Destroy()
+	atomic.AddInt64(&p.recycled, 1)
+	return fresh
+}
+
+// expired reports whether a worker has crossed one of the pool's limits
+func (p *Pool) expired(uses int, created time.Time, heap int) bool {
+	if p.opts.MaxUsesPerWorker > 0 && uses >= p.opts.MaxUsesPerWorker {
+		return true
+	}
+	if p.opts.MaxAge > 0 && time.Since(created) >= p.opts.MaxAge {
+		return true
+	}
+	if p.opts.MaxHeapPerWorker > 0 && heap >= p.opts.MaxHeapPerWorker {
+		return true
+	}
+	return false
+}
+
+// how often idle workers measure their heap size for Stats
+const heapSampleInterval = time.Second
+
+// sampleHeap measures the heap size of the worker w's context cx and
+// records it for Stats
+func (p *Pool) sampleHeap(cx *Context, w *worker) int {
+	heap, err := cx.HeapSize()
+	if err != nil {
+		return 0
+	}
+	atomic.StoreInt64(&w.heap, int64(heap))
+	return heap
+}
+
+// forget drops the state kept for cx once it leaves the pool
+func (p *Pool) forget(cx *Context) {
+	p.objMu.Lock()
+	delete(p.objects, cx)
+	p.objMu.Unlock()
+}
+
+// object returns the Object that op refers to in cx, or nil if cx has
+// left the pool
+func (p *Pool) object(cx *Context, op *ObjectPool) *Object {
+	p.objMu.Lock()
+	defer p.objMu.Unlock()
+	return p.objects[cx][op]
+}
+
+// setObject records o as the Object that op refers to in cx
+func (p *Pool) setObject(cx *Context, op *ObjectPool, o *Object) {
+	p.objMu.Lock()
+	defer p.objMu.Unlock()
+	if objs, ok := p.objects[cx]; ok {
+		objs[op] = o
+	}
+}
+
+// contexts returns a snapshot of the worker contexts
+func (p *Pool) contexts() []*Context {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]*Context(nil), p.cxs...)
+}
+
+// work runs calls from the pool in cx until the pool is destroyed or the
+// worker is asked to quit
+func (p *Pool) work(cx *Context, w *worker) {
+	defer p.wg.Done()
+	uses, created := 0, time.Now()
+	heap, sampled := p.sampleHeap(cx, w), time.Now()
+	for {
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if idle := p.idleTimeout(); idle > 0 {
+			timer = time.NewTimer(idle)
+			expired = timer.C
+		}
+		select {
+		case fn, ok := <-p.in:
+			if timer != nil {
+				timer.Stop()
+			}
+			if !ok {
+				p.retire(cx, 0)
+				return
+			}
+			if !p.claim(fn) {
+				continue // caller gave up waiting
+			}
+			p.run(cx, fn)
+			fn.done <- true
+			uses++
+			if p.opts.MaxHeapPerWorker > 0 || time.Since(sampled) >= heapSampleInterval {
+				heap, sampled = p.sampleHeap(cx, w), time.Now()
+			}
+			if p.expired(uses, created, heap) {
+				cx = p.recycle(cx)
+				uses, created = 0, time.Now()
+				heap, sampled = p.sampleHeap(cx, w), time.Now()
+			}
+		case job := <-w.pin:
+			if timer != nil {
+				timer.Stop()
+			}
+			job(cx)
+		case q := <-p.quit:
+			if timer != nil {
+				timer.Stop()
+			}
+			ok := p.retire(cx, q.min)
+			close(q.done)
+			if ok {
+				return
+			}
+		case <-expired:
+			if p.retire(cx, p.minSize()) {
+				return
+			}
+		}
+	}
+}
+
+// retire removes cx from the pool and destroys it, unless that would
+// leave fewer than min workers
+func (p *Pool) retire(cx *Context, min int) bool {
+	p.mu.Lock()
+	if int(atomic.LoadInt64(&p.n)) <= min {
+		p.mu.Unlock()
+		return false
+	}
+	for i, c := range p.cxs {
+		if c == cx {
+			p.cxs = append(p.cxs[:i], p.cxs[i+1:]...)
+			break
+		}
+	}
+	if w, ok := p.workers[cx]; ok {
+		close(w.gone)
+		delete(p.workers, cx)
+	}
+	p.forget(cx)
+	atomic.AddInt64(&p.n, -1)
+	p.mu.Unlock()
+	cx.Destroy()
+	return true
+}
+
+func (p *Pool) idleTimeout() time.Duration {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.idle
+}
+
+func (p *Pool) minSize() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.min
+}
+
+// Size returns the current number of workers in the pool.
+func (p *Pool) Size() int {
+	return int(atomic.LoadInt64(&p.n))
+}
+
+// Resize grows or shrinks the pool to n workers. New workers are set up
+// by replaying the pool's recorded setup calls. When shrinking, Resize
+// waits for the workers it removes to finish their current call.
+func (p *Pool) Resize(n int) error {
+	if n < 1 {
+		return fmt.Errorf("pool size must be at least 1 but got %d", n)
+	}
+	if !p.IsValid() {
+		return ErrPoolDestroyed
+	}
+	p.resize.Lock()
+	defer p.resize.Unlock()
+	for p.Size() < n {
+		if err := p.spawn(); err != nil {
+			return err
+		}
+	}
+	// idle workers may retire meanwhile, so recount each time and never
+	// take the pool below n
+	for p.Size() > n {
+		q := quit{min: n, done: make(chan bool)}
+		select {
+		case p.quit <- q:
+			<-q.done
+		case <-p.done:
+			return ErrPoolDestroyed
+		}
+	}
+	return nil
+}
+
+// Autoscale lets the pool grow up to max workers while callers are
+// waiting for a free worker, and shrink back towards min workers once
+// workers have been idle for the idle duration. A zero idle duration
+// never shrinks the pool. The pool is resized to fit within [min, max].
+func (p *Pool) Autoscale(min, max int, idle time.Duration) error {
+	if min < 1 || max < min {
+		return fmt.Errorf("invalid autoscale bounds: min %d max %d", min, max)
+	}
+	if !p.IsValid() {
+		return ErrPoolDestroyed
+	}
+	p.mu.Lock()
+	p.min, p.idle = min, idle
+	atomic.StoreInt64(&p.max, int64(max))
+	p.mu.Unlock()
+	n := p.Size()
+	if n < min {
+		return p.Resize(min)
+	}
+	if n > max {
+		return p.Resize(max)
+	}
+	return nil
+}
+
+// canGrow reports whether the pool is autoscaling and not yet at its
+// maximum size
+func (p *Pool) canGrow() bool {
+	return atomic.LoadInt64(&p.n) < atomic.LoadInt64(&p.max)
+}
+
+// starved reports whether more callers are waiting than there are free
+// workers
+func (p *Pool) starved() bool {
+	free := atomic.LoadInt64(&p.n) - atomic.LoadInt64(&p.busy)
+	return atomic.LoadInt64(&p.waiting) > free
+}
+
+// grow starts a new worker if the pool can grow
+func (p *Pool) grow() bool {
+	p.resize.Lock()
+	defer p.resize.Unlock()
+	if !p.canGrow() || !p.IsValid() {
+		return false
+	}
+	return p.spawn() == nil
+}
+
+// scale starts workers while callers are waiting for one and the pool can
+// grow. Workers are started here when enqueue asks for one rather than by
+// the waiting callers, so that they can give up meanwhile and are served
+// by whichever worker is free first.
+func (p *Pool) scale() {
+	for {
+		select {
+		case <-p.expand:
+			for p.starved() && p.grow() {
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// all runs step in every worker context and records it so that workers
+// started later are set up the same way. If step fails in any worker it
+// is not recorded. Steps are serialised by setupMu and run without p.mu
+// held, so the pool carries on serving calls and can grow meanwhile.
+func (p *Pool) all(step func(cx *Context) error) error {
+	p.setupMu.Lock()
+	defer p.setupMu.Unlock()
+	if !p.IsValid() {
+		return ErrPoolDestroyed
+	}
+	cxs := p.contexts()
+	if err := p.each(cxs, func(i int, cx *Context) error { return step(cx) }); err != nil {
+		return err
+	}
+	// workers started from here on replay step themselves, those started
+	// since the snapshot have to be given it
+	p.mu.Lock()
+	p.setup = append(p.setup, step)
+	var missed []*Context
 	for _, cx := range p.cxs {
-		err = cx.DefineFunction(name, fun)
+		if !hasContext(cxs, cx) {
+			missed = append(missed, cx)
+		}
+	}
+	p.mu.Unlock()
+	return p.each(missed, func(i int, cx *Context) error { return step(cx) })
+}
+
+// each runs fn in parallel in each of cxs, returning PoolErrors if any
+// fail. fn runs on the context's worker between calls, so it waits for any
+// call or Session holding the worker to finish. Contexts that have left
+// the pool (retired or recycled) by then are skipped. A *PanicError
+// re-panicked in any worker is re-panicked once they have all finished.
+func (p *Pool) each(cxs []*Context, fn func(i int, cx *Context) error) error {
+	errs := make([]error, len(cxs))
+	panics := make([]*PanicError, len(cxs))
+	var wg sync.WaitGroup
+	for i, cx := range cxs {
+		p.mu.RLock()
+		w, ok := p.workers[cx]
+		p.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, cx *Context) {
+			defer wg.Done()
+			done := make(chan bool)
+			job := func(current *Context) {
+				defer close(done)
+				if current == cx {
+					errs[i] = p.call(cx, func(cx *Context) error { return fn(i, cx) }, &panics[i])
+				}
+			}
+			select {
+			case w.pin <- job:
+				<-done
+			case <-w.gone:
+			}
+		}(i, cx)
+	}
+	wg.Wait()
+	for _, pe := range panics {
+		if pe != nil {
+			panic(pe)
+		}
+	}
+	var perrs PoolErrors
+	for i, err := range errs {
 		if err != nil {
-			return
+			perrs = append(perrs, &WorkerError{i, err})
 		}
 	}
+	if len(perrs) > 0 {
+		return perrs
+	}
 	return nil
 }
 
+func hasContext(cxs []*Context, cx *Context) bool {
+	for _, c := range cxs {
+		if c == cx {
+			return true
+		}
+	}
+	return false
+}
+
+// WorkerError is an error raised in one worker of a Pool.
+type WorkerError struct {
+	Worker int // index of the worker
+	Err    error
+}
+
+func (err *WorkerError) Error() string {
+	return fmt.Sprintf("worker %d: %s", err.Worker, err.Err.Error())
+}
+
+func (err *WorkerError) Unwrap() error {
+	return err.Err
+}
+
+// PoolErrors is returned by calls that run in ALL contexts within the
+// pool (ExecAll, EvalAll, DefineFunction etc) when any of them fail.
+type PoolErrors []*WorkerError
+
+func (errs PoolErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Result is the value of an expression evaluated in one worker of a
+// Pool, see EvalAll.
+type Result struct {
+	Worker int   // index of the worker
+	Err    error // error raised in the worker if any
+	data   []byte
+	codec  *codec
+}
+
+// Scan converts the value into v in the same way as Eval.
+func (r Result) Scan(v interface{}) error {
+	if r.Err != nil {
+		return r.Err
+	}
+	if raw, ok := v.(*Raw); ok {
+		b, err := untag(r.data)
+		if err != nil {
+			return err
+		}
+		*raw = Raw(b)
+		return nil
+	}
+	return r.codec.unmarshal(r.data, v)
+}
+
+// Create a go function mapping in ALL contexts within the pool.
+// See context's description for more details.
+func (p *Pool) DefineFunction(name string, fun interface{}) (err error) {
+	return p.all(func(cx *Context) error {
+		return cx.DefineFunction(name, fun)
+	})
+}
+
 // Create an object in ALL contexts within the pool.
 // See context's description for more details.
 func (p *Pool) DefineObject(name string, proxy interface{}) (Definer, error) {
-	op := &ObjectPool{p, make([]*Object, p.n)}
-	for i, cx := range p.cxs {
+	op := &ObjectPool{p}
+	err := p.all(func(cx *Context) error {
 		o, err := cx.DefineObject(name, proxy)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		op.objects[i] = o.(*Object)
+		p.setObject(cx, op, o.(*Object))
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return op, nil
 }
 
+// Register a type converter in ALL contexts within the pool.
+// See context's description for more details.
+func (p *Pool) RegisterConverter(t reflect.Type, to, from func(interface{}) (interface{}, error)) (err error) {
+	return p.all(func(cx *Context) error {
+		return cx.RegisterConverter(t, to, from)
+	})
+}
+
+// Enable or disable strict conversions in ALL contexts within the pool.
+// See context's description for more details.
+func (p *Pool) SetStrict(strict bool) error {
+	return p.all(func(cx *Context) error {
+		cx.SetStrict(strict)
+		return nil
+	})
+}
+
+// Enable or disable Map and Set encoding of Go maps in ALL contexts within
+// the pool. See context's description for more details.
+func (p *Pool) SetNativeMaps(enabled bool) error {
+	return p.all(func(cx *Context) error {
+		cx.SetNativeMaps(enabled)
+		return nil
+	})
+}
+
 // Execute source js in the first available worker context and return
 // the result of the expression to result.
 func (p *Pool) Eval(source string, result interface{}) (err error) {
-	p.one(func(cx *Context) {
-		err = cx.Eval(source, result)
+	return p.one(Normal, "", func(cx *Context) error {
+		return cx.Eval(source, result)
+	})
+}
+
+// EvalContext is like Eval but gives up with ErrPoolBusy if ctx is done
+// before a worker becomes available. Once running, ctx is made available
+// to Go functions as with Context.EvalContext.
+func (p *Pool) EvalContext(ctx context.Context, source string, result interface{}) (err error) {
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return p.oneContext(ctx, Normal, "", func(cx *Context) error {
+		return cx.EvalContext(ctx, source, result)
+	})
+}
+
+// ExecContext is like Exec but gives up with ErrPoolBusy if ctx is done
+// before a worker becomes available. Once running, ctx is made available
+// to Go functions as with Context.ExecContext.
+func (p *Pool) ExecContext(ctx context.Context, source string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return p.oneContext(ctx, Normal, "", func(cx *Context) error {
+		return cx.ExecContext(ctx, source)
 	})
-	return err
 }
 
 // Execute source js in the first available worker context.
 // Errors are returned but the value of the expression is discarded.
 func (p *Pool) Exec(source string) (err error) {
-	p.one(func(cx *Context) {
-		err = cx.Exec(source)
+	return p.one(Normal, "", func(cx *Context) error {
+		return cx.Exec(source)
+	})
+}
+
+// Call a javascript function in the first available worker context.
+// See context's description for more details.
+func (p *Pool) Call(fn string, result interface{}, args ...interface{}) (err error) {
+	return p.one(Normal, "", func(cx *Context) error {
+		return cx.Call(fn, result, args...)
 	})
-	return err
+}
+
+// Implement an interface or struct of funcs with a javascript object.
+// Each call is made in the first available worker context.
+// See context's description for more details.
+func (p *Pool) Implement(v interface{}, path string, impl interface{}) error {
+	return implement(p, v, path, impl)
 }
 
 // Execute js from a file in the next available worker context.
 func (p *Pool) ExecFile(filename string) (err error) {
-	p.one(func(cx *Context) {
-		err = cx.ExecFile(filename)
+	return p.one(Normal, "", func(cx *Context) error {
+		return cx.ExecFile(filename)
 	})
-	return err
 }
 
-// Executes the given js source in ALL contexts.
-// Execution will stop at the first error if one is raised.
-func (p *Pool) ExecAll(source string) (err error) {
-	for _, cx := range p.cxs {
-		err = cx.Exec(source)
-		if err != nil {
-			break
-		}
+// Evaluates the given js source in ALL contexts in parallel and returns
+// the result from each worker. If any fail the error is a PoolErrors
+// listing each failure and the matching Result holds the error.
+// Each worker evaluates source once it is free, so EvalAll waits for
+// running calls and Sessions to finish.
+func (p *Pool) EvalAll(source string) ([]Result, error) {
+	if !p.IsValid() {
+		return nil, ErrPoolDestroyed
 	}
-	return err
+	cxs := p.contexts()
+	results := make([]Result, 0, len(cxs))
+	var mu sync.Mutex
+	err := p.each(cxs, func(i int, cx *Context) error {
+		b, err := cx.evalJSON(nil, nil, source, true)
+		mu.Lock()
+		results = append(results, Result{Worker: i, Err: err, data: b, codec: cx.codec})
+		mu.Unlock()
+		return err
+	})
+	sort.Slice(results, func(i, j int) bool { return results[i].Worker < results[j].Worker })
+	return results, err
+}
+
+// Executes the given js source in ALL contexts in parallel.
+// If any fail the error is a PoolErrors listing each failure.
+func (p *Pool) ExecAll(source string) (err error) {
+	return p.all(func(cx *Context) error {
+		return cx.Exec(source)
+	})
 }
 
-// Load filename into ALL contexts in the pool.
-// Execution will stop at the first error if one is raised.
+// Load filename into ALL contexts in the pool in parallel.
+// The file is read once. If any fail the error is a PoolErrors
+// listing each failure.
 func (p *Pool) ExecFileAll(filename string) (err error) {
-	for _, cx := range p.cxs {
-		err = cx.ExecFile(filename)
-		if err != nil {
-			break
-		}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return p.execAll([]sourceFile{{filename, string(b)}})
+}
+
+// Execute js from an io.Reader in ALL contexts in the pool in parallel.
+// The reader is consumed once. If any fail the error is a PoolErrors
+// listing each failure.
+func (p *Pool) ExecFromAll(r io.Reader) (err error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return p.execAll([]sourceFile{{"ExecFromAll", string(b)}})
+}
+
+// Execute the files in fsys matching pattern in lexical order in the
+// next available worker context. See context's description for more details.
+func (p *Pool) ExecFS(fsys fs.FS, pattern string) (err error) {
+	scripts, err := readFS(fsys, pattern)
+	if err != nil {
+		return err
+	}
+	return p.one(Normal, "", func(cx *Context) error {
+		return cx.execScripts(scripts)
+	})
+}
+
+// Execute the files in fsys matching pattern in lexical order in ALL
+// contexts in the pool in parallel. The files are read once. If any fail
+// the error is a PoolErrors listing each failure.
+func (p *Pool) ExecFSAll(fsys fs.FS, pattern string) (err error) {
+	scripts, err := readFS(fsys, pattern)
+	if err != nil {
+		return err
 	}
-	return err
+	return p.execAll(scripts)
+}
+
+func (p *Pool) execAll(scripts []sourceFile) error {
+	return p.all(func(cx *Context) error {
+		return cx.execScripts(scripts)
+	})
 }
 
 // Execute js from an io.Reader in the first available worker
 // context.
 func (p *Pool) ExecFrom(r io.Reader) (err error) {
-	p.one(func(cx *Context) {
-		err = cx.ExecFrom(r)
+	return p.one(Normal, "", func(cx *Context) error {
+		return cx.ExecFrom(r)
 	})
-	return err
 }
 
 // Stop the worker threads, destroy all the contexts in the pool.
 // This will release any goroutines waiting on the pool.
-// Attempting to use a pool after it has been destroyed will cause
-// a runtime panic.
+// Attempting to use a pool after it has been destroyed returns
+// ErrPoolDestroyed.
 func (p *Pool) Destroy() {
-	if !p.Valid {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !atomic.CompareAndSwapInt32(&p.valid, 1, 0) {
 		return
 	}
+	close(p.done)
+	<-p.dispatched
 	close(p.in)
-	p.Valid = false
-	p.cxs = nil
 }
 
-// Grab a free worker and exec callback
-func (p *Pool) one(callback func(cx *Context)) {
-	if !p.Valid {
-		panic("attempt to use a pool after it was destroyed")
-	}
-	fn := &pfn{
-		call: callback,
-		done: make(chan bool, 1),
+// IsValid reports whether the pool is usable, ie. it has not been
+// destroyed.
+func (p *Pool) IsValid() bool {
+	return atomic.LoadInt32(&p.valid) == 1
+}
+
+// Grab a free worker and exec callback, returning its error.
+// Calls without a deadline still respect the queue limit and fail with
+// ErrPoolBusy when it is full.
+func (p *Pool) one(pr Priority, tenant string, callback func(cx *Context) error) error {
+	return p.oneContext(nil, pr, tenant, callback)
+}
+
+// Grab a free worker and exec callback, giving up with ErrPoolBusy if
+// ctx is done first or the queue is full. A nil ctx waits forever.
+func (p *Pool) oneContext(ctx context.Context, pr Priority, tenant string, callback func(cx *Context) error) error {
+	fn := newPfn(pr, tenant, callback)
+	if err := p.enqueue(ctx, fn); err != nil {
+		return err
 	}
-	p.in <- fn
 	<-fn.done
-	return
+	if fn.panic != nil {
+		panic(fn.panic)
+	}
+	return fn.err
+}
+
+// enqueue queues fn for the dispatcher and waits for a worker to claim it
+func (p *Pool) enqueue(ctx context.Context, fn *pfn) error {
+	if !p.IsValid() {
+		return ErrPoolDestroyed
+	}
+	n := atomic.AddInt64(&p.waiting, 1)
+	defer atomic.AddInt64(&p.waiting, -1)
+	if free := atomic.LoadInt64(&p.n) - atomic.LoadInt64(&p.busy); n > free {
+		if p.canGrow() {
+			select {
+			case p.expand <- true:
+			default:
+			}
+		} else if max := atomic.LoadInt64(&p.maxQueue); max > 0 && n-free > max {
+			atomic.AddInt64(&p.rejected, 1)
+			return ErrPoolBusy
+		}
+	}
+	fn.queued = time.Now()
+	p.sched.push(fn)
+	select {
+	case p.wake <- true:
+	default:
+	}
+	var done <-chan struct{}
+	if ctx != nil {
+		done = ctx.Done()
+	}
+	select {
+	case <-fn.started:
+		return nil
+	case <-done:
+		if fn.cancel() {
+			atomic.AddInt64(&p.rejected, 1)
+			return ErrPoolBusy
+		}
+	case <-p.done:
+		if fn.cancel() {
+			return ErrPoolDestroyed
+		}
+	}
+	<-fn.started // claimed while giving up
+	return nil
+}
+
+// claim marks fn as running on a worker and records how long it waited
+func (p *Pool) claim(fn *pfn) bool {
+	atomic.AddInt64(&p.busy, 1)
+	if !fn.claim() {
+		atomic.AddInt64(&p.busy, -1)
+		return false
+	}
+	wait := time.Since(fn.queued)
+	p.sched.waits[fn.priority].add(wait)
+	p.waits.add(wait)
+	return true
+}
+
+// run calls fn in cx recording execution stats
+func (p *Pool) run(cx *Context, fn *pfn) {
+	defer atomic.AddInt64(&p.busy, -1)
+	start := time.Now()
+	err := p.call(cx, fn.call, &fn.panic)
+	fn.err = err
+	if fn.session {
+		return
+	}
+	p.execs.add(time.Since(start))
+	if err != nil {
+		atomic.AddInt64(&p.errors, 1)
+	}
+}
+
+// call runs fn in cx on a worker, recovering a *PanicError re-panicked
+// under PanicRepanic into pe so that it can be re-panicked on the caller's
+// goroutine instead of killing the worker. Other panics are not recovered.
+func (p *Pool) call(cx *Context, fn func(cx *Context) error, pe **PanicError) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*PanicError)
+			if !ok {
+				panic(r)
+			}
+			*pe = e
+			err = e
+		}
+	}()
+	return fn(cx)
+}
+
+// SetMaxQueue limits the number of callers that may wait for a free
+// worker. Once n callers are waiting further calls fail immediately with
+// ErrPoolBusy. Zero means no limit.
+func (p *Pool) SetMaxQueue(n int) {
+	atomic.StoreInt64(&p.maxQueue, int64(n))
+}
+
+// QueueLength returns the number of callers currently waiting for a
+// free worker.
+func (p *Pool) QueueLength() int {
+	return int(atomic.LoadInt64(&p.waiting))
+}
+
+// Recycled returns the number of workers that have been replaced after
+// crossing one of the limits in the pool's PoolOptions.
+func (p *Pool) Recycled() int64 {
+	return atomic.LoadInt64(&p.recycled)
+}
+
+// Rejected returns the number of calls that have given up waiting for a
+// worker with ErrPoolBusy.
+func (p *Pool) Rejected() int64 {
+	return atomic.LoadInt64(&p.rejected)
 }
 
 func (p *Pool) Wait() {
 	p.wg.Wait()
 }
 
+// ObjectPool is the Definer returned by Pool.DefineObject, it refers to
+// the same object in every worker context.
 type ObjectPool struct {
-	p       *Pool
-	objects []*Object
+	p *Pool
 }
 
 func (op *ObjectPool) DefineFunction(name string, fun interface{}) (err error) {
-	for _, o := range op.objects {
-		err = o.DefineFunction(name, fun)
-		if err != nil {
-			return
+	return op.p.all(func(cx *Context) error {
+		o := op.p.object(cx, op)
+		if o == nil {
+			return ErrContextDestroyed
 		}
-	}
-	return
+		return o.DefineFunction(name, fun)
+	})
 }
 
 func (op *ObjectPool) DefineObject(name string, proxy interface{}) (Definer, error) {
-	op2 := &ObjectPool{op.p, make([]*Object, op.p.n)}
-	for i, o := range op.objects {
-		o, err := o.DefineObject(name, proxy)
+	op2 := &ObjectPool{op.p}
+	err := op.p.all(func(cx *Context) error {
+		o := op.p.object(cx, op)
+		if o == nil {
+			return ErrContextDestroyed
+		}
+		child, err := o.DefineObject(name, proxy)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		op2.objects[i] = o.(*Object)
+		op.p.setObject(cx, op2, child.(*Object))
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return op2, nil
 }
@@ -1,10 +1,13 @@
 package jsapi
 
 import (
+	"context"
 	"fmt"
 	"runtime"
+	"strings"
 	"sync"
 	"testing"
+	"testing/fstest"
 	"time"
 )
 
@@ -30,6 +33,7 @@ func BenchmarkEvalPool(b *testing.B) {
 
 func TestPoolInterface(t *testing.T) {
 	var _ Evaluator = &Pool{}
+	var _ Caller = &Pool{}
 	var _ Definer = &Pool{}
 	var _ Definer = &ObjectPool{}
 }
@@ -427,3 +431,545 @@ func TestPoolFunctionWithWeirdScope(t *testing.T) {
 	}
 
 }
+
+func TestPoolEvalContextBusy(t *testing.T) {
+
+	p := NewPool(1)
+	defer p.Destroy()
+
+	s, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	var i int
+	if err := p.EvalContext(ctx, `1+1`, &i); err != ErrPoolBusy {
+		t.Fatalf("expected ErrPoolBusy while the only worker is busy but got %v", err)
+	}
+	if n := p.Rejected(); n != 1 {
+		t.Fatalf("expected 1 rejected call but got %d", n)
+	}
+
+}
+
+func TestPoolMaxQueue(t *testing.T) {
+
+	p := NewPool(1)
+	defer p.Destroy()
+	p.SetMaxQueue(1)
+
+	s, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fill the queue
+	queued := make(chan error, 1)
+	go func() {
+		queued <- p.ExecContext(context.Background(), `1`)
+	}()
+	for p.QueueLength() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := p.ExecContext(context.Background(), `1`); err != ErrPoolBusy {
+		t.Fatalf("expected ErrPoolBusy with a full queue but got %v", err)
+	}
+
+	s.Release()
+	if err := <-queued; err != nil {
+		t.Fatalf("expected queued call to run after release but got %v", err)
+	}
+	if n := p.QueueLength(); n != 0 {
+		t.Fatalf("expected an empty queue but got %d", n)
+	}
+
+}
+
+func TestPoolResize(t *testing.T) {
+
+	p := NewPool(2)
+	defer p.Destroy()
+
+	p.DefineFunction("double", func(i int) int { return i * 2 })
+	math, err := p.DefineObject("math", &person{"bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	math.DefineFunction("add", func(a, b int) int { return a + b })
+	if err := p.ExecAll(`var base = 10`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Resize(4); err != nil {
+		t.Fatal(err)
+	}
+	if n := p.Size(); n != 4 {
+		t.Fatalf("expected pool size 4 after Resize(4) but got %d", n)
+	}
+
+	// check out every worker so each one is checked
+	sessions := make([]*Session, 4)
+	for i := range sessions {
+		s, err := p.Acquire(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions[i] = s
+	}
+	for i, s := range sessions {
+		var n int
+		if err := s.Eval(`double(base) + math.add(1, 2)`, &n); err != nil {
+			t.Fatalf("worker %d: %v", i, err)
+		}
+		if n != 23 {
+			t.Fatalf("expected worker %d to be set up and return 23 but got %d", i, n)
+		}
+		s.Release()
+	}
+
+	if err := p.Resize(1); err != nil {
+		t.Fatal(err)
+	}
+	if n := p.Size(); n != 1 {
+		t.Fatalf("expected pool size 1 after Resize(1) but got %d", n)
+	}
+
+}
+
+func TestPoolAutoscale(t *testing.T) {
+
+	p := NewPool(1)
+	defer p.Destroy()
+
+	if err := p.Autoscale(1, 3, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	p.ExecAll(`var ready = true`)
+
+	sessions := make([]*Session, 3)
+	for i := range sessions {
+		s, err := p.Acquire(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ready bool
+		if err := s.Eval(`ready`, &ready); err != nil || !ready {
+			t.Fatalf("expected new worker to be set up but got %v %v", ready, err)
+		}
+		sessions[i] = s
+	}
+	if n := p.Size(); n != 3 {
+		t.Fatalf("expected pool to grow to 3 workers but got %d", n)
+	}
+	for _, s := range sessions {
+		s.Release()
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for p.Size() > 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := p.Size(); n != 1 {
+		t.Fatalf("expected idle workers to shrink pool to 1 but got %d", n)
+	}
+
+}
+
+func TestPoolRecycleWorkers(t *testing.T) {
+
+	p := NewPoolWithOptions(1, PoolOptions{MaxUsesPerWorker: 2})
+	defer p.Destroy()
+
+	if err := p.ExecAll(`var ready = true`); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Exec(`var junk = 1`); err != nil {
+		t.Fatal(err)
+	}
+	var s string
+	if err := p.Eval(`typeof junk`, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s != "number" {
+		t.Fatalf("expected junk to exist before the worker is recycled but got %s", s)
+	}
+
+	// the worker has now served 2 calls and been replaced
+	if err := p.Eval(`typeof junk`, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s != "undefined" {
+		t.Fatalf("expected junk to be gone after the worker is recycled but got %s", s)
+	}
+	var ready bool
+	if err := p.Eval(`ready`, &ready); err != nil {
+		t.Fatal(err)
+	}
+	if !ready {
+		t.Fatalf("expected recycled worker to be set up again")
+	}
+	if n := p.Recycled(); n != 1 {
+		t.Fatalf("expected 1 recycled worker but got %d", n)
+	}
+
+}
+
+func TestPoolRecycleWorkersOnHeap(t *testing.T) {
+
+	p := NewPoolWithOptions(1, PoolOptions{MaxHeapPerWorker: 1})
+	defer p.Destroy()
+
+	for i := 0; i < 4; i++ {
+		if err := p.Exec(`var big = new Array(1000).join('x')`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the last replacement may still be in progress
+	if n := p.Recycled(); n < 3 {
+		t.Fatalf("expected every call to exceed the heap limit and recycle but got %d", n)
+	}
+
+}
+
+type counter struct {
+	N int
+}
+
+func TestPoolWithInit(t *testing.T) {
+
+	var mu sync.Mutex
+	counters := []*counter{}
+	p, err := NewPoolWithInit(POOL_SIZE, func(cx *Context) error {
+		c := &counter{}
+		mu.Lock()
+		counters = append(counters, c)
+		mu.Unlock()
+		_, err := cx.DefineObject("counter", c)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Destroy()
+
+	if len(counters) != POOL_SIZE {
+		t.Fatalf("expected init to be called for each of %d workers but got %d", POOL_SIZE, len(counters))
+	}
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.Exec(`counter.n = counter.n + 1`); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	total := 0
+	for _, c := range counters {
+		total += c.N
+	}
+	if total != 100 {
+		t.Fatalf("expected per-worker counters to total 100 but got %d", total)
+	}
+
+}
+
+func TestPoolWithInitError(t *testing.T) {
+
+	calls := 0
+	p, err := NewPoolWithInit(POOL_SIZE, func(cx *Context) error {
+		calls++
+		if calls == 3 {
+			return cx.Exec(`throw new Error('bad init')`)
+		}
+		return nil
+	})
+	if err == nil {
+		t.Fatalf("expected init error to abort pool creation")
+	}
+	if p != nil {
+		t.Fatalf("expected no pool to be returned when init fails")
+	}
+	if calls != 3 {
+		t.Fatalf("expected init to stop after the failing worker but was called %d times", calls)
+	}
+
+}
+
+func TestPoolSynchronizedObject(t *testing.T) {
+
+	type Config struct {
+		Name  string
+		Count int
+	}
+
+	p := NewPool(POOL_SIZE)
+	defer p.Destroy()
+
+	var mu sync.Mutex
+	cfg := &Config{}
+	if _, err := p.DefineObject("cfg", Synchronized(cfg, &mu)); err != nil {
+		t.Fatal(err)
+	}
+
+	// writes from many workers at once must not race (run with -race)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := p.Exec(fmt.Sprintf(`cfg.name = "w%d"; cfg.count = %d; cfg.name + cfg.count`, i, i))
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	mu.Lock()
+	name := cfg.Name
+	mu.Unlock()
+	if len(name) < 2 || name[0] != 'w' {
+		t.Fatalf("expected cfg.Name to be set by one of the workers but got %q", name)
+	}
+
+}
+
+func TestPoolEvalAll(t *testing.T) {
+
+	id := 0
+	p, err := NewPoolWithInit(POOL_SIZE, func(cx *Context) error {
+		err := cx.Exec(fmt.Sprintf(`var id = %d`, id))
+		id++
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Destroy()
+
+	results, err := p.EvalAll(`id * 2`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != POOL_SIZE {
+		t.Fatalf("expected %d results but got %d", POOL_SIZE, len(results))
+	}
+	for i, r := range results {
+		var n int
+		if err := r.Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if r.Worker != i || n != i*2 {
+			t.Fatalf("expected worker %d to return %d but got worker %d returning %d", i, i*2, r.Worker, n)
+		}
+	}
+
+	results, err = p.EvalAll(`({id: id, at: new Date(0), seen: new Set([id])})`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw Raw
+	if err := results[1].Scan(&raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw != `{"id":1,"at":"1970-01-01T00:00:00.000Z","seen":{}}` {
+		t.Fatalf("expected Raw to scan the plain JSON of the result but got %s", raw)
+	}
+
+	_, err = p.EvalAll(`if( id % 2 ){ throw new Error('odd') }; id`)
+	errs, ok := err.(PoolErrors)
+	if !ok {
+		t.Fatalf("expected PoolErrors but got %T %v", err, err)
+	}
+	if len(errs) != POOL_SIZE/2 {
+		t.Fatalf("expected %d errors but got %d: %v", POOL_SIZE/2, len(errs), err)
+	}
+	for _, e := range errs {
+		if e.Worker%2 != 1 {
+			t.Fatalf("expected only odd workers to fail but got %v", e)
+		}
+	}
+
+	err = p.ExecAll(`if( id === 3 ){ throw new Error('three') }`)
+	errs, ok = err.(PoolErrors)
+	if !ok || len(errs) != 1 || errs[0].Worker != 3 {
+		t.Fatalf("expected ExecAll to report worker 3 failing but got %v", err)
+	}
+
+}
+
+func TestPoolExecFromAll(t *testing.T) {
+
+	p := NewPool(POOL_SIZE)
+	defer p.Destroy()
+
+	if err := p.ExecFromAll(strings.NewReader(`var loaded = true`)); err != nil {
+		t.Fatal(err)
+	}
+	err := p.ExecFSAll(fstest.MapFS{
+		"1.js": {Data: []byte(`var n = 1`)},
+		"2.js": {Data: []byte(`n = n * 10`)},
+	}, "*.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Resize(POOL_SIZE + 1); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := p.EvalAll(`loaded && n`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		var n int
+		if err := r.Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != 10 {
+			t.Fatalf("expected worker %d to have loaded the scripts once but got %d", r.Worker, n)
+		}
+	}
+
+}
+
+func TestDestroyedPool(t *testing.T) {
+
+	p := NewPool(1)
+	p.Destroy()
+
+	if err := p.Exec(`1`); err != ErrPoolDestroyed {
+		t.Fatalf("expected Exec to return ErrPoolDestroyed but got %v", err)
+	}
+	var i int
+	if err := p.Eval(`1`, &i); err != ErrPoolDestroyed {
+		t.Fatalf("expected Eval to return ErrPoolDestroyed but got %v", err)
+	}
+	if err := p.DefineFunction("f", func() {}); err != ErrPoolDestroyed {
+		t.Fatalf("expected DefineFunction to return ErrPoolDestroyed but got %v", err)
+	}
+	if err := p.SetStrict(true); err != ErrPoolDestroyed {
+		t.Fatalf("expected SetStrict to return ErrPoolDestroyed but got %v", err)
+	}
+	if _, err := p.Acquire(context.Background()); err != ErrPoolDestroyed {
+		t.Fatalf("expected Acquire to return ErrPoolDestroyed but got %v", err)
+	}
+	if err := p.Resize(2); err != ErrPoolDestroyed {
+		t.Fatalf("expected Resize to return ErrPoolDestroyed but got %v", err)
+	}
+	if err := p.Autoscale(1, 2, time.Second); err != ErrPoolDestroyed {
+		t.Fatalf("expected Autoscale to return ErrPoolDestroyed but got %v", err)
+	}
+
+}
+
+func TestPoolSetupCallsBackIntoPool(t *testing.T) {
+
+	p := NewPool(2)
+	defer p.Destroy()
+
+	err := p.DefineFunction("size", func() int {
+		return p.Size()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.ExecAll(`if( size() !== 2 ){ throw new Error('unexpected size') }`)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected ExecAll to return but it deadlocked")
+	}
+
+}
+
+func TestPoolResizeReplaysCallsBackIntoPool(t *testing.T) {
+
+	p := NewPool(2)
+	defer p.Destroy()
+
+	err := p.DefineFunction("size", func() int {
+		return p.Size()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ExecAll(`var startedWith = size()`); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Resize(3)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected Resize to return but it deadlocked")
+	}
+	if n := p.Size(); n != 3 {
+		t.Fatalf("expected pool size 3 after Resize(3) but got %d", n)
+	}
+
+}
+
+func TestPoolPanicRepanic(t *testing.T) {
+
+	p, err := NewPoolWithInit(2, func(cx *Context) error {
+		cx.SetPanicPolicy(PanicRepanic)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Destroy()
+
+	err = p.DefineFunction("raise", func() {
+		panic("BANG")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, run := range map[string]func(){
+		"Exec":    func() { p.Exec(`try { raise() } catch(e) {}`) },
+		"ExecAll": func() { p.ExecAll(`raise()`) },
+	} {
+		func() {
+			defer func() {
+				r := recover()
+				if pe, ok := r.(*PanicError); !ok || pe.Value != "BANG" {
+					t.Errorf("expected %s to re-panic with the PanicError but got %v", name, r)
+				}
+			}()
+			run()
+		}()
+	}
+
+	var i int
+	for n := 0; n < POOL_SIZE; n++ {
+		if err := p.Eval(`1`, &i); err != nil || i != 1 {
+			t.Fatalf("expected pool to be usable after re-panic but got %v", err)
+		}
+	}
+
+}
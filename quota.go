@@ -0,0 +1,193 @@
+package jsapi
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Quota limits how much a script may call Go functions. Zero values mean
+// no limit. Per evaluation limits apply to a top level call such as Eval
+// or Exec, including any evaluations nested within it.
+//
+// MaxTime is measured as the CPU time of the Context's worker thread, on
+// which Go functions run, so time spent blocked (sleeping, waiting on I/O
+// or locks) and work done by other goroutines is not counted.
+type Quota struct {
+	MaxCalls int           // calls per evaluation
+	MaxTime  time.Duration // CPU time spent running Go functions per evaluation
+	Rate     float64       // sustained calls per second, across evaluations
+	Burst    int           // calls that may be made at once before Rate applies
+}
+
+// QuotaExceeded is thrown into javascript, with the name "QuotaExceeded",
+// when a call to a Go function would exceed a Quota. If the script does
+// not catch it the returned *ErrorReport carries it as its Quota field.
+// Use OnQuota to learn of quotas exceeded whether or not they are caught.
+type QuotaExceeded struct {
+	Function string // the function called
+	Scope    string // the function's name for a function quota, "" for the Context's
+	Limit    string // "calls", "time" or "rate"
+}
+
+func (e *QuotaExceeded) Error() string {
+	if e.Scope == "" {
+		return fmt.Sprintf("%s: context %s quota exceeded", e.Function, e.Limit)
+	}
+	return fmt.Sprintf("%s: %s quota exceeded", e.Function, e.Limit)
+}
+
+// SetQuota limits calls to all of the Context's Go functions combined.
+func (cx *Context) SetQuota(q Quota) {
+	cx.quotas.set("", q)
+}
+
+// SetFunctionQuota limits calls to the Go functions defined as name, on
+// the global object or any other. It applies in addition to SetQuota.
+func (cx *Context) SetFunctionQuota(name string, q Quota) {
+	cx.quotas.set(name, q)
+}
+
+// OnQuota sets fn to be called each time a call to a Go function exceeds
+// a Quota, before the QuotaExceeded is thrown, so that it is seen even if
+// the script catches it. Passing nil removes the hook. fn is called on the
+// Context's worker thread so must not block on the Context.
+func (cx *Context) OnQuota(fn func(*QuotaExceeded)) {
+	cx.hookMu.Lock()
+	defer cx.hookMu.Unlock()
+	cx.onQuota = fn
+}
+
+// quotaExceeded passes e to the OnQuota hook if there is one
+func (cx *Context) quotaExceeded(e *QuotaExceeded) {
+	cx.hookMu.Lock()
+	fn := cx.onQuota
+	cx.hookMu.Unlock()
+	if fn != nil {
+		fn(e)
+	}
+}
+
+// quotas holds the limiters of a Context keyed by function name, with ""
+// for the Context wide quota
+type quotas struct {
+	mu       sync.Mutex
+	limiters map[string]*limiter
+}
+
+type limiter struct {
+	scope  string
+	q      Quota
+	tokens float64
+	last   time.Time
+}
+
+// usage is the consumption of a limiter during one evaluation
+type usage struct {
+	calls int
+	time  time.Duration
+}
+
+func (qs *quotas) set(name string, q Quota) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	if qs.limiters == nil {
+		qs.limiters = make(map[string]*limiter)
+	}
+	if q == (Quota{}) {
+		delete(qs.limiters, name)
+		return
+	}
+	burst := q.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	qs.limiters[name] = &limiter{scope: name, q: q, tokens: float64(burst), last: time.Now()}
+}
+
+// enterQuota checks the quotas for a call to the function name, counting it
+// against them, and returns a func to record the CPU time the call took.
+// Must be called from the Context's worker thread.
+func (cx *Context) enterQuota(name string) (func(), error) {
+	qs := &cx.quotas
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	var active []*limiter
+	for _, key := range [2]string{"", name} {
+		if l, ok := qs.limiters[key]; ok {
+			active = append(active, l)
+		}
+	}
+	if len(active) == 0 {
+		return func() {}, nil
+	}
+	var f *frame
+	if len(cx.frames) > 0 {
+		f = cx.frames[0]
+	}
+	now, cpu := time.Now(), threadTime()
+	for _, l := range active {
+		u := f.usage(l)
+		switch {
+		case l.q.MaxCalls > 0 && u.calls >= l.q.MaxCalls:
+			return nil, cx.exceeded(name, l.scope, "calls")
+		case l.q.MaxTime > 0 && u.time >= l.q.MaxTime:
+			return nil, cx.exceeded(name, l.scope, "time")
+		case l.q.Rate > 0 && l.refill(now) < 1:
+			return nil, cx.exceeded(name, l.scope, "rate")
+		}
+	}
+	for _, l := range active {
+		f.usage(l).calls++
+		if l.q.Rate > 0 {
+			l.tokens--
+		}
+	}
+	return func() {
+		d := threadTime() - cpu
+		for _, l := range active {
+			f.usage(l).time += d
+		}
+	}, nil
+}
+
+// exceeded records a QuotaExceeded against the running evaluation
+func (cx *Context) exceeded(name, scope, limit string) *QuotaExceeded {
+	e := &QuotaExceeded{Function: name, Scope: scope, Limit: limit}
+	if n := len(cx.frames); n > 0 && cx.frames[n-1].quota == nil {
+		cx.frames[n-1].quota = e
+	}
+	return e
+}
+
+// refill tops up the limiter's tokens for the time since it was last
+// used and returns how many are available
+func (l *limiter) refill(now time.Time) float64 {
+	burst := float64(l.q.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	l.tokens += now.Sub(l.last).Seconds() * l.q.Rate
+	if l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+	return l.tokens
+}
+
+// usage returns the frame's consumption of l, a nil frame (a call made
+// outside of any evaluation) has nothing to count against
+func (f *frame) usage(l *limiter) *usage {
+	if f == nil {
+		return &usage{}
+	}
+	if f.quotas == nil {
+		f.quotas = make(map[*limiter]*usage)
+	}
+	u, ok := f.quotas[l]
+	if !ok {
+		u = &usage{}
+		f.quotas[l] = u
+	}
+	return u
+}
@@ -0,0 +1,91 @@
+package jsapi
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestQuotaMaxCalls(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	n := 0
+	cx.DefineFunction("work", func() { n++ })
+	cx.SetFunctionQuota("work", Quota{MaxCalls: 3})
+
+	err := cx.Exec(`for( var i = 0; i < 10; i++ ){ work() }`)
+	var qe *QuotaExceeded
+	if !errors.As(err, &qe) {
+		t.Fatalf("expected a QuotaExceeded error but got: %T %v", err, err)
+	}
+	if qe.Function != "work" || qe.Limit != "calls" {
+		t.Fatalf("expected the calls quota of work to be exceeded but got %+v", qe)
+	}
+	if n != 3 {
+		t.Fatalf("expected work to be called 3 times but got %d", n)
+	}
+
+	// counts are per evaluation
+	var name string
+	if err := cx.Eval(`work(); try { work(); work(); work() } catch(e) { e.name }`, &name); err != nil {
+		t.Fatal(err)
+	}
+	if name != "QuotaExceeded" {
+		t.Fatalf("expected javascript to catch a QuotaExceeded error but got %q", name)
+	}
+
+	// the hook sees quotas exceeded even when they are caught
+	var seen []*QuotaExceeded
+	cx.OnQuota(func(e *QuotaExceeded) { seen = append(seen, e) })
+	if err := cx.Exec(`try { work(); work(); work(); work() } catch(e) {}`); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 1 || seen[0].Function != "work" || seen[0].Limit != "calls" {
+		t.Fatalf("expected OnQuota to be called once for the calls quota of work but got %+v", seen)
+	}
+
+}
+
+func TestQuotaTime(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	cx.DefineFunction("slow", func() {
+		for start := time.Now(); time.Since(start) < 5*time.Millisecond; {
+		}
+	})
+	cx.DefineFunction("sleepy", func() { time.Sleep(5 * time.Millisecond) })
+	cx.SetQuota(Quota{MaxTime: 10 * time.Millisecond})
+
+	if err := cx.Exec(`for( var i = 0; i < 10; i++ ){ sleepy() }`); err != nil {
+		t.Fatalf("expected time spent sleeping not to count against the quota but got: %v", err)
+	}
+	err := cx.Exec(`for( var i = 0; i < 10; i++ ){ slow() }`)
+	var qe *QuotaExceeded
+	if !errors.As(err, &qe) || qe.Limit != "time" || qe.Scope != "" {
+		t.Fatalf("expected the context time quota to be exceeded but got: %v", err)
+	}
+
+}
+
+func TestQuotaRate(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	cx.DefineFunction("ping", func() {})
+	cx.SetFunctionQuota("ping", Quota{Rate: 1, Burst: 2})
+
+	if err := cx.Exec(`ping(); ping()`); err != nil {
+		t.Fatal(err)
+	}
+	err := cx.Exec(`ping()`)
+	var qe *QuotaExceeded
+	if !errors.As(err, &qe) || qe.Limit != "rate" {
+		t.Fatalf("expected the rate quota to be exceeded but got: %v", err)
+	}
+
+}
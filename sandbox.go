@@ -0,0 +1,61 @@
+package jsapi
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// freezeKey is the global holding the deep freeze helper used by Freeze
+const freezeKey = "__jsapi_freeze__"
+
+// Options configures a Context, see NewContextWithOptions.
+type Options struct {
+	// Globals whitelists the standard classes and functions (eg. "Math",
+	// "JSON", "Date", "parseInt") defined on the global object. Nil defines
+	// them all. Classes that are not listed and are not needed internally
+	// (Math, Proxy, WeakMap, Intl, typed arrays etc) are never created, so
+	// scripts have no way to reach them.
+	//
+	// The classes the engine needs to evaluate literals and throw errors
+	// (Object, Function, Array, String, Number, Boolean, RegExp and the
+	// Error types) and those used to convert values (JSON, Date, Map and
+	// Set) are always created. When not listed they are removed from the
+	// global object, but remain reachable from values of their type, eg.
+	// ({}).constructor or the constructor of a Date passed in from Go.
+	// undefined, NaN and Infinity are always defined.
+	//
+	// Naming a global that does not exist is an error.
+	Globals []string
+	// DisableEval stops scripts generating code from strings, eval() and
+	// new Function() throw an EvalError.
+	DisableEval bool
+}
+
+// identPath matches a javascript identifier or dotted path of identifiers
+var identPath = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*(\.[A-Za-z_$][A-Za-z0-9_$]*)*$`)
+
+// isIdent reports whether name is a plain javascript identifier
+func isIdent(name string) bool {
+	return !strings.Contains(name, ".") && identPath.MatchString(name)
+}
+
+// Freeze deep-freezes the object at path (eg. "api" or "app.services")
+// so that scripts cannot add, remove or replace its properties or those
+// of any object reachable from it. Properties of proxy objects defined
+// with DefineObject are still read and written through to Go.
+// path must be an identifier or dotted path of identifiers.
+func (cx *Context) Freeze(path string) error {
+	if !identPath.MatchString(path) {
+		return fmt.Errorf("invalid path %q", path)
+	}
+	return cx.exec(nil, fmt.Sprintf("%s(%s)", freezeKey, path), "freeze")
+}
+
+// Deep-freeze the object at path in ALL contexts within the pool.
+// See context's description for more details.
+func (p *Pool) Freeze(path string) error {
+	return p.all(func(cx *Context) error {
+		return cx.Freeze(path)
+	})
+}
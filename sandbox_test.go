@@ -0,0 +1,102 @@
+package jsapi
+
+import (
+	"testing"
+)
+
+func TestOptionsGlobals(t *testing.T) {
+
+	cx, err := NewContextWithOptions(Options{Globals: []string{"Object", "JSON"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cx.Destroy()
+
+	var kinds []string
+	if err := cx.Eval(`[typeof Object, typeof JSON, typeof Math, typeof Array]`, &kinds); err != nil {
+		t.Fatal(err)
+	}
+	if kinds[0] != "function" || kinds[1] != "object" {
+		t.Fatalf("expected Object and JSON to be installed but got %v", kinds)
+	}
+	if kinds[2] != "undefined" || kinds[3] != "undefined" {
+		t.Fatalf("expected Math and Array to be removed but got %v", kinds)
+	}
+
+	// values still cross the boundary without the globals
+	cx.DefineFunction("echo", func(xs []int) []int { return xs })
+	var xs []int
+	if err := cx.Call("echo", &xs, []int{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if len(xs) != 2 {
+		t.Fatalf("expected echo to return 2 values but got %v", xs)
+	}
+	var name string
+	if err := cx.Eval(`try { echo('x') } catch(e) { e.name }`, &name); err != nil {
+		t.Fatal(err)
+	}
+	if name != "TypeError" {
+		t.Fatalf("expected a TypeError without the TypeError global but got %q", name)
+	}
+
+	for _, name := range []string{"NoSuchClass", "Math,Date", ""} {
+		if _, err := NewContextWithOptions(Options{Globals: []string{name}}); err == nil {
+			t.Fatalf("expected an error for the global %q", name)
+		}
+	}
+
+}
+
+func TestOptionsDisableEval(t *testing.T) {
+
+	cx, err := NewContextWithOptions(Options{DisableEval: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cx.Destroy()
+
+	if err := cx.Exec(`eval('1+1')`); err == nil {
+		t.Fatalf("expected eval to be blocked")
+	}
+	if err := cx.Exec(`new Function('return 1')`); err == nil {
+		t.Fatalf("expected new Function to be blocked")
+	}
+	var i int
+	if err := cx.Eval(`1+1`, &i); err != nil {
+		t.Fatal(err)
+	}
+
+}
+
+func TestFreeze(t *testing.T) {
+
+	cx := NewContext()
+	defer cx.Destroy()
+
+	if err := cx.Exec(`var api = { version: 1, util: { greet: function(){ return 'hi' } } }`); err != nil {
+		t.Fatal(err)
+	}
+	if err := cx.Freeze("api"); err != nil {
+		t.Fatal(err)
+	}
+
+	var s string
+	err := cx.Eval(`
+		api.version = 2;
+		api.util.greet = function(){ return 'pwned' };
+		api.extra = true;
+		api.version + ' ' + api.util.greet() + ' ' + api.extra
+	`, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "1 hi undefined" {
+		t.Fatalf("expected frozen api to be unchanged but got %q", s)
+	}
+
+	if err := cx.Freeze("api); api.hacked = (1"); err == nil {
+		t.Fatalf("expected an error freezing an invalid path")
+	}
+
+}
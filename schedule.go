@@ -0,0 +1,403 @@
+package jsapi
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Priority is the scheduling class of calls made on a Pool. When workers
+// are busy, waiting calls of a higher priority are run first.
+type Priority int
+
+const (
+	Low Priority = iota
+	Normal
+	High
+	numPriorities
+)
+
+func (pr Priority) String() string {
+	switch pr {
+	case Low:
+		return "low"
+	case Normal:
+		return "normal"
+	case High:
+		return "high"
+	}
+	return "unknown"
+}
+
+// how long a call may wait before being promoted a class (see SetAging)
+const defaultAging = time.Second
+
+// states of a queued pfn
+const (
+	pfnQueued int32 = iota
+	pfnRunning
+	pfnCancelled
+)
+
+// claim marks fn as running, it fails if the caller has given up
+func (fn *pfn) claim() bool {
+	if !atomic.CompareAndSwapInt32(&fn.state, pfnQueued, pfnRunning) {
+		return false
+	}
+	close(fn.started)
+	return true
+}
+
+// cancel marks fn as abandoned by the caller, it fails if a worker has
+// already claimed it
+func (fn *pfn) cancel() bool {
+	return atomic.CompareAndSwapInt32(&fn.state, pfnQueued, pfnCancelled)
+}
+
+// scheduler holds the calls waiting for a worker. Classes are served in
+// priority order, except that calls are promoted a class for each aging
+// period they have waited so that low priority work is never starved.
+// Within a class tenants are served in proportion to their weights using
+// virtual time: each call dispatched advances its tenant's clock by
+// 1/weight and the tenant with the earliest clock goes next.
+type scheduler struct {
+	mu      sync.Mutex
+	classes [numPriorities]*class
+	weights map[string]int
+	aging   time.Duration
+	waits   [numPriorities]*durations
+}
+
+type class struct {
+	tenants map[string]*tenant
+	vclock  float64 // virtual time of the last dispatched call
+}
+
+type tenant struct {
+	queue  []*pfn
+	vclock float64
+}
+
+func newScheduler() *scheduler {
+	s := &scheduler{
+		weights: make(map[string]int),
+		aging:   defaultAging,
+	}
+	for i := range s.classes {
+		s.classes[i] = &class{tenants: make(map[string]*tenant)}
+		s.waits[i] = &durations{}
+	}
+	return s
+}
+
+// push queues fn
+func (s *scheduler) push(fn *pfn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.classes[fn.priority]
+	t, ok := c.tenants[fn.tenant]
+	if !ok {
+		t = &tenant{}
+		c.tenants[fn.tenant] = t
+	}
+	if len(t.queue) == 0 && t.vclock < c.vclock {
+		// an idle tenant does not get to bank time while away
+		t.vclock = c.vclock
+	}
+	t.queue = append(t.queue, fn)
+}
+
+// peek returns the next call to dispatch or nil if none are waiting.
+// Calls abandoned by their callers are dropped.
+func (s *scheduler) peek() *pfn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, t := s.next(time.Now())
+	if t == nil {
+		return nil
+	}
+	return t.queue[0]
+}
+
+// pop removes fn, previously returned by peek, once it is dispatched
+func (s *scheduler) pop(fn *pfn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.classes[fn.priority]
+	t := c.tenants[fn.tenant]
+	if t == nil || len(t.queue) == 0 || t.queue[0] != fn {
+		return
+	}
+	t.queue[0] = nil
+	t.queue = t.queue[1:]
+	t.vclock += 1 / float64(s.weight(fn.tenant))
+	c.vclock = t.vclock
+	if len(t.queue) == 0 {
+		delete(c.tenants, fn.tenant)
+	}
+}
+
+// next picks the class and tenant to be served next. s.mu must be held.
+func (s *scheduler) next(now time.Time) (*class, *tenant) {
+	var best *class
+	var bestTenant *tenant
+	bestScore := -1
+	for pr := len(s.classes) - 1; pr >= 0; pr-- {
+		c := s.classes[pr]
+		var oldest time.Time
+		var first *tenant
+		for name, t := range c.tenants {
+			for len(t.queue) > 0 && atomic.LoadInt32(&t.queue[0].state) == pfnCancelled {
+				t.queue[0] = nil
+				t.queue = t.queue[1:]
+			}
+			if len(t.queue) == 0 {
+				delete(c.tenants, name)
+				continue
+			}
+			if oldest.IsZero() || t.queue[0].queued.Before(oldest) {
+				oldest = t.queue[0].queued
+			}
+			if first == nil || t.vclock < first.vclock {
+				first = t
+			}
+		}
+		if first == nil {
+			continue
+		}
+		score := pr
+		if s.aging > 0 {
+			score += int(now.Sub(oldest) / s.aging)
+		}
+		if score > bestScore {
+			best, bestTenant, bestScore = c, first, score
+		}
+	}
+	return best, bestTenant
+}
+
+func (s *scheduler) weight(name string) int {
+	if w, ok := s.weights[name]; ok {
+		return w
+	}
+	return 1
+}
+
+func (s *scheduler) setWeight(name string, weight int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if weight < 1 {
+		weight = 1
+	}
+	s.weights[name] = weight
+}
+
+func (s *scheduler) setAging(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.aging = d
+}
+
+// durations records a running count of durations along with a window
+// of recent samples to estimate quantiles from
+type durations struct {
+	mu      sync.Mutex
+	count   int64
+	total   time.Duration
+	max     time.Duration
+	samples [1024]time.Duration
+}
+
+// DurationStats summarises a set of durations. P50 and P99 are estimated
+// from the most recent samples.
+type DurationStats struct {
+	Count int64
+	Total time.Duration // sum of all the durations
+	Mean  time.Duration
+	P50   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+func (d *durations) add(x time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.samples[d.count%int64(len(d.samples))] = x
+	d.count++
+	d.total += x
+	if x > d.max {
+		d.max = x
+	}
+}
+
+func (d *durations) stats() DurationStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	st := DurationStats{Count: d.count, Total: d.total, Max: d.max}
+	if d.count == 0 {
+		return st
+	}
+	st.Mean = d.total / time.Duration(d.count)
+	n := int(d.count)
+	if n > len(d.samples) {
+		n = len(d.samples)
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, d.samples[:n])
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	st.P50 = sorted[(n-1)*50/100]
+	st.P99 = sorted[(n-1)*99/100]
+	return st
+}
+
+// dispatch hands queued calls to workers as they become free, until the
+// pool is destroyed. A newly queued call wakes it to reconsider which
+// call should go next.
+func (p *Pool) dispatch() {
+	defer close(p.dispatched)
+	for {
+		fn := p.sched.peek()
+		var in chan *pfn
+		if fn != nil {
+			in = p.in
+		}
+		select {
+		case in <- fn:
+			p.sched.pop(fn)
+		case <-p.wake:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// SetTenantWeight sets the share of workers given to calls made with
+// WithTenant(name) relative to other tenants of the same priority when
+// the pool is busy. The default weight is 1.
+func (p *Pool) SetTenantWeight(name string, weight int) {
+	p.sched.setWeight(name, weight)
+}
+
+// SetAging sets how long a waiting call may be passed over by calls of a
+// higher priority before it is promoted a class, so that low priority
+// work still makes progress on a busy pool. Zero disables promotion.
+func (p *Pool) SetAging(d time.Duration) {
+	p.sched.setAging(d)
+}
+
+// WaitTimes returns how long calls of each priority have waited for a
+// worker.
+func (p *Pool) WaitTimes() map[Priority]DurationStats {
+	m := make(map[Priority]DurationStats, len(p.sched.waits))
+	for pr, d := range p.sched.waits {
+		m[Priority(pr)] = d.stats()
+	}
+	return m
+}
+
+// WithPriority returns a Lane for making calls on the pool at priority pr.
+//
+//	p.WithPriority(jsapi.High).Eval(`render()`, &html)
+func (p *Pool) WithPriority(pr Priority) *Lane {
+	return &Lane{p: p, priority: pr}
+}
+
+// WithTenant returns a Lane for making calls on the pool on behalf of the
+// tenant name. When the pool is busy tenants are served fairly according
+// to their weights (see SetTenantWeight).
+func (p *Pool) WithTenant(name string) *Lane {
+	return &Lane{p: p, priority: Normal, tenant: name}
+}
+
+// Lane makes calls on a Pool with a given priority and tenant. It
+// implements the Evaluator interface.
+type Lane struct {
+	p        *Pool
+	priority Priority
+	tenant   string
+}
+
+// WithPriority returns a copy of the lane with priority pr.
+func (l *Lane) WithPriority(pr Priority) *Lane {
+	return &Lane{p: l.p, priority: pr, tenant: l.tenant}
+}
+
+// WithTenant returns a copy of the lane for the tenant name.
+func (l *Lane) WithTenant(name string) *Lane {
+	return &Lane{p: l.p, priority: l.priority, tenant: name}
+}
+
+// See Pool.Eval.
+func (l *Lane) Eval(source string, result interface{}) (err error) {
+	return l.p.one(l.priority, l.tenant, func(cx *Context) error {
+		return cx.Eval(source, result)
+	})
+}
+
+// See Pool.EvalContext.
+func (l *Lane) EvalContext(ctx context.Context, source string, result interface{}) (err error) {
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return l.p.oneContext(ctx, l.priority, l.tenant, func(cx *Context) error {
+		return cx.EvalContext(ctx, source, result)
+	})
+}
+
+// See Pool.Exec.
+func (l *Lane) Exec(source string) (err error) {
+	return l.p.one(l.priority, l.tenant, func(cx *Context) error {
+		return cx.Exec(source)
+	})
+}
+
+// See Pool.ExecContext.
+func (l *Lane) ExecContext(ctx context.Context, source string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return l.p.oneContext(ctx, l.priority, l.tenant, func(cx *Context) error {
+		return cx.ExecContext(ctx, source)
+	})
+}
+
+// See Pool.ExecFile.
+func (l *Lane) ExecFile(filename string) (err error) {
+	return l.p.one(l.priority, l.tenant, func(cx *Context) error {
+		return cx.ExecFile(filename)
+	})
+}
+
+// See Pool.ExecFrom.
+func (l *Lane) ExecFrom(r io.Reader) (err error) {
+	return l.p.one(l.priority, l.tenant, func(cx *Context) error {
+		return cx.ExecFrom(r)
+	})
+}
+
+// See Pool.ExecFS.
+func (l *Lane) ExecFS(fsys fs.FS, pattern string) (err error) {
+	scripts, err := readFS(fsys, pattern)
+	if err != nil {
+		return err
+	}
+	return l.p.one(l.priority, l.tenant, func(cx *Context) error {
+		return cx.execScripts(scripts)
+	})
+}
+
+// See Pool.Call.
+func (l *Lane) Call(fn string, result interface{}, args ...interface{}) (err error) {
+	return l.p.one(l.priority, l.tenant, func(cx *Context) error {
+		return cx.Call(fn, result, args...)
+	})
+}
+
+// See Pool.Acquire.
+func (l *Lane) Acquire(ctx context.Context) (*Session, error) {
+	return l.p.acquire(ctx, l.priority, l.tenant)
+}
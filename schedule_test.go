@@ -0,0 +1,132 @@
+package jsapi
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLaneInterface(t *testing.T) {
+	var _ Evaluator = &Lane{}
+	var _ Caller = &Lane{}
+}
+
+// queueCalls checks out the only worker of p, queues the calls made by
+// each of fns in turn and returns the order they ran in once the worker
+// is released.
+func queueCalls(t *testing.T, p *Pool, fns ...func(record string) error) []string {
+	var mu sync.Mutex
+	order := []string{}
+	p.DefineFunction("record", func(s string) {
+		mu.Lock()
+		order = append(order, s)
+		mu.Unlock()
+	})
+
+	s, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := new(sync.WaitGroup)
+	for i, fn := range fns {
+		wg.Add(1)
+		go func(fn func(string) error) {
+			defer wg.Done()
+			if err := fn(`record`); err != nil {
+				t.Error(err)
+			}
+		}(fn)
+		for p.QueueLength() < i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	s.Release()
+	wg.Wait()
+	return order
+}
+
+func TestPoolPriority(t *testing.T) {
+
+	p := NewPool(1)
+	defer p.Destroy()
+	p.SetAging(0)
+
+	call := func(l *Lane, name string) func(string) error {
+		return func(record string) error {
+			return l.Exec(fmt.Sprintf(`%s(%q)`, record, name))
+		}
+	}
+	order := queueCalls(t, p,
+		call(p.WithPriority(Low), "low1"),
+		call(p.WithPriority(Normal), "normal"),
+		call(p.WithPriority(Low), "low2"),
+		call(p.WithPriority(High), "high"),
+	)
+	exp := "[high normal low1 low2]"
+	if fmt.Sprint(order) != exp {
+		t.Fatalf("expected calls to run in priority order %s but got %v", exp, order)
+	}
+
+	waits := p.WaitTimes()
+	if waits[High].Count != 1 || waits[Low].Count != 2 {
+		t.Fatalf("expected wait times to be recorded per priority but got %v", waits)
+	}
+	if waits[Low].Max < waits[High].Max {
+		t.Fatalf("expected low priority calls to wait longer than high but got %v", waits)
+	}
+
+}
+
+func TestPoolTenantFairness(t *testing.T) {
+
+	p := NewPool(1)
+	defer p.Destroy()
+
+	call := func(tenant string) func(string) error {
+		return func(record string) error {
+			return p.WithTenant(tenant).Exec(fmt.Sprintf(`%s(%q)`, record, tenant))
+		}
+	}
+	fns := []func(string) error{}
+	for i := 0; i < 6; i++ {
+		fns = append(fns, call("batch"))
+	}
+	fns = append(fns, call("web"), call("web"))
+	order := queueCalls(t, p, fns...)
+
+	// although queued last, web is served alternately with batch
+	web := 0
+	for _, tenant := range order[:4] {
+		if tenant == "web" {
+			web++
+		}
+	}
+	if web != 2 {
+		t.Fatalf("expected both web calls within the first 4 run but got %v", order)
+	}
+
+}
+
+func TestPoolAging(t *testing.T) {
+
+	p := NewPool(1)
+	defer p.Destroy()
+	p.SetAging(time.Millisecond)
+
+	order := queueCalls(t, p,
+		func(record string) error {
+			return p.WithPriority(Low).Exec(record + `("low")`)
+		},
+		func(record string) error {
+			time.Sleep(10 * time.Millisecond) // let the low call age
+			return p.WithPriority(High).Exec(record + `("high")`)
+		},
+	)
+	exp := "[low high]"
+	if fmt.Sprint(order) != exp {
+		t.Fatalf("expected the starved low priority call to be promoted %s but got %v", exp, order)
+	}
+
+}
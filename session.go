@@ -0,0 +1,179 @@
+package jsapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"sync"
+)
+
+// ErrSessionReleased is returned when a Session is used after Release.
+var ErrSessionReleased = errors.New("attempt to use a released session")
+
+// Session is a single worker Context checked out of a Pool with Acquire.
+// Unlike calls made directly on the Pool, every call made through a Session
+// runs in the same Context, so state set up by one call (global variables,
+// defined functions) is visible to the next.
+//
+// The worker is unavailable to the rest of the Pool until Release is called,
+// so always release sessions when done with them:
+//
+//	s, err := p.Acquire(ctx)
+//	if err != nil {
+//		return err
+//	}
+//	defer s.Release()
+//	s.Exec(`var x = 1`)
+//	s.Eval(`x`, &x)
+//
+// Anything defined in a Session remains in that worker Context after it
+// is released.
+type Session struct {
+	cx      *Context
+	mu      sync.RWMutex
+	done    chan bool
+	release sync.Once
+}
+
+// Acquire checks out a worker Context for exclusive use, waiting for one to
+// become free if necessary. If ctx is done before a worker is available, or
+// the pool's queue is full, ErrPoolBusy is returned.
+func (p *Pool) Acquire(ctx context.Context) (*Session, error) {
+	return p.acquire(ctx, Normal, "")
+}
+
+func (p *Pool) acquire(ctx context.Context, pr Priority, tenant string) (*Session, error) {
+	if !p.IsValid() {
+		return nil, ErrPoolDestroyed
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s := &Session{
+		done: make(chan bool),
+	}
+	acquired := make(chan *Context, 1)
+	fn := newPfn(pr, tenant, func(cx *Context) error {
+		acquired <- cx
+		<-s.done // hold the worker until released
+		return nil
+	})
+	fn.session = true
+	if err := p.enqueue(ctx, fn); err != nil {
+		return nil, err
+	}
+	s.cx = <-acquired
+	return s, nil
+}
+
+// Release returns the worker to the Pool. It is safe to call Release
+// more than once, but the Session must not be used afterwards.
+func (s *Session) Release() {
+	s.release.Do(func() {
+		s.mu.Lock()
+		s.cx = nil
+		s.mu.Unlock()
+		close(s.done)
+	})
+}
+
+// context returns the session's Context or nil if released
+func (s *Session) context() *Context {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cx
+}
+
+// Execute javascript source in the session's Context.
+func (s *Session) Exec(source string) (err error) {
+	cx := s.context()
+	if cx == nil {
+		return ErrSessionReleased
+	}
+	return cx.Exec(source)
+}
+
+// Execute javascript source in the session's Context with ctx available
+// to Go functions. See Context.ExecContext.
+func (s *Session) ExecContext(ctx context.Context, source string) (err error) {
+	cx := s.context()
+	if cx == nil {
+		return ErrSessionReleased
+	}
+	return cx.ExecContext(ctx, source)
+}
+
+// Execute javascript source in the session's Context and scan the
+// response into result.
+func (s *Session) Eval(source string, result interface{}) (err error) {
+	cx := s.context()
+	if cx == nil {
+		return ErrSessionReleased
+	}
+	return cx.Eval(source, result)
+}
+
+// Execute javascript source in the session's Context with ctx available
+// to Go functions. See Context.EvalContext.
+func (s *Session) EvalContext(ctx context.Context, source string, result interface{}) (err error) {
+	cx := s.context()
+	if cx == nil {
+		return ErrSessionReleased
+	}
+	return cx.EvalContext(ctx, source, result)
+}
+
+// Execute javascript from a file in the session's Context.
+func (s *Session) ExecFile(filename string) (err error) {
+	cx := s.context()
+	if cx == nil {
+		return ErrSessionReleased
+	}
+	return cx.ExecFile(filename)
+}
+
+// Execute javascript from an io.Reader in the session's Context.
+func (s *Session) ExecFrom(r io.Reader) (err error) {
+	cx := s.context()
+	if cx == nil {
+		return ErrSessionReleased
+	}
+	return cx.ExecFrom(r)
+}
+
+// Execute the files in fsys matching pattern in the session's Context.
+func (s *Session) ExecFS(fsys fs.FS, pattern string) (err error) {
+	cx := s.context()
+	if cx == nil {
+		return ErrSessionReleased
+	}
+	return cx.ExecFS(fsys, pattern)
+}
+
+// Call a javascript function in the session's Context.
+func (s *Session) Call(fn string, result interface{}, args ...interface{}) (err error) {
+	cx := s.context()
+	if cx == nil {
+		return ErrSessionReleased
+	}
+	return cx.Call(fn, result, args...)
+}
+
+// Define a function in the session's Context only.
+func (s *Session) DefineFunction(name string, fun interface{}) error {
+	cx := s.context()
+	if cx == nil {
+		return ErrSessionReleased
+	}
+	return cx.DefineFunction(name, fun)
+}
+
+// Define an object in the session's Context only.
+func (s *Session) DefineObject(name string, proxy interface{}) (Definer, error) {
+	cx := s.context()
+	if cx == nil {
+		return nil, ErrSessionReleased
+	}
+	return cx.DefineObject(name, proxy)
+}
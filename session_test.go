@@ -0,0 +1,125 @@
+package jsapi
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionInterface(t *testing.T) {
+	var _ Evaluator = &Session{}
+	var _ Definer = &Session{}
+	var _ Caller = &Session{}
+}
+
+func TestSessionKeepsState(t *testing.T) {
+
+	p := NewPool(POOL_SIZE)
+	defer p.Destroy()
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s, err := p.Acquire(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer s.Release()
+			if err := s.Exec(fmt.Sprintf(`var x = %d`, i)); err != nil {
+				t.Error(err)
+				return
+			}
+			var x int
+			if err := s.Eval(`x`, &x); err != nil {
+				t.Error(err)
+				return
+			}
+			if x != i {
+				t.Errorf("expected session to see x = %d but got %d", i, x)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+}
+
+func TestSessionRelease(t *testing.T) {
+
+	p := NewPool(1)
+	defer p.Destroy()
+
+	s, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the only worker is checked out so acquiring another must time out
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.Acquire(ctx); err != ErrPoolBusy {
+		t.Fatalf("expected ErrPoolBusy while worker checked out but got %v", err)
+	}
+
+	s.Release()
+	s.Release()
+	if err := s.Exec(`1`); err != ErrSessionReleased {
+		t.Fatalf("expected ErrSessionReleased after Release but got %v", err)
+	}
+
+	var i int
+	if err := p.Eval(`1+1`, &i); err != nil {
+		t.Fatal(err)
+	}
+	if i != 2 {
+		t.Fatalf("expected 1+1 to eval to 2 but got %d", i)
+	}
+
+}
+
+func TestSessionExecAllWaits(t *testing.T) {
+
+	p := NewPool(1)
+	defer p.Destroy()
+
+	s, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Exec(`var x = 1`); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.ExecAll(`x = 2`)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("expected ExecAll to wait for the session but it returned %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	var x int
+	if err := s.Eval(`x`, &x); err != nil {
+		t.Fatal(err)
+	}
+	if x != 1 {
+		t.Fatalf("expected x to be 1 while the session is held but got %d", x)
+	}
+
+	s.Release()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Eval(`x`, &x); err != nil {
+		t.Fatal(err)
+	}
+	if x != 2 {
+		t.Fatalf("expected x to be 2 after ExecAll but got %d", x)
+	}
+
+}
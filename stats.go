@@ -0,0 +1,129 @@
+package jsapi
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// PoolStats is a snapshot of a Pool's activity, see Pool.Stats.
+type PoolStats struct {
+	Workers    int                        // current number of workers
+	Busy       int                        // workers running a call or held by a Session
+	QueueDepth int                        // callers waiting for a worker
+	Executions int64                      // calls run (excluding Sessions)
+	Errors     int64                      // calls that returned an error
+	Rejected   int64                      // calls that gave up with ErrPoolBusy
+	Recycled   int64                      // workers replaced due to PoolOptions limits
+	ExecTime   DurationStats              // time spent running calls
+	WaitTime   DurationStats              // time spent waiting for a worker
+	WaitTimes  map[Priority]DurationStats // WaitTime by priority
+	Heap       []int                      // heap size in bytes of each worker
+}
+
+// Stats returns a snapshot of the pool's activity. Worker heap sizes are
+// measured after calls, at most once a second per worker, so may lag.
+func (p *Pool) Stats() PoolStats {
+	st := PoolStats{
+		Busy:       int(atomic.LoadInt64(&p.busy)),
+		QueueDepth: p.QueueLength(),
+		Errors:     atomic.LoadInt64(&p.errors),
+		Rejected:   p.Rejected(),
+		Recycled:   p.Recycled(),
+		ExecTime:   p.execs.stats(),
+		WaitTime:   p.waits.stats(),
+		WaitTimes:  p.WaitTimes(),
+	}
+	st.Executions = st.ExecTime.Count
+	p.mu.RLock()
+	st.Workers = p.Size()
+	st.Heap = make([]int, len(p.cxs))
+	for i, cx := range p.cxs {
+		if w, ok := p.workers[cx]; ok {
+			st.Heap[i] = int(atomic.LoadInt64(&w.heap))
+		}
+	}
+	p.mu.RUnlock()
+	return st
+}
+
+// Publish exports the pool's Stats as the expvar name, so that they are
+// served as JSON from /debug/vars. Like expvar.Publish it panics if name
+// is already in use.
+func (p *Pool) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return p.Stats()
+	}))
+}
+
+// WritePrometheus writes the pool's Stats to w in the Prometheus text
+// exposition format, with each metric name prefixed by prefix (eg.
+// "myapp_jsapi"). It can be called from an existing /metrics handler.
+func (p *Pool) WritePrometheus(w io.Writer, prefix string) error {
+	st := p.Stats()
+	m := &metrics{w: w, prefix: prefix}
+	m.metric("workers", "gauge", "Number of workers in the pool.", float64(st.Workers))
+	m.metric("busy_workers", "gauge", "Workers running a call or held by a session.", float64(st.Busy))
+	m.metric("queue_depth", "gauge", "Callers waiting for a worker.", float64(st.QueueDepth))
+	m.metric("executions_total", "counter", "Calls run by the pool.", float64(st.Executions))
+	m.metric("errors_total", "counter", "Calls that returned an error.", float64(st.Errors))
+	m.metric("rejected_total", "counter", "Calls that gave up waiting for a worker.", float64(st.Rejected))
+	m.metric("recycled_total", "counter", "Workers replaced after crossing a limit.", float64(st.Recycled))
+	m.summary("exec_seconds", "Time spent running calls.", "", st.ExecTime)
+	m.header("wait_seconds", "summary", "Time spent waiting for a worker.")
+	for pr := Low; pr < numPriorities; pr++ {
+		m.quantiles("wait_seconds", fmt.Sprintf("priority=%q", pr.String()), st.WaitTimes[pr])
+	}
+	m.header("heap_bytes", "gauge", "Javascript heap size of each worker.")
+	for i, heap := range st.Heap {
+		m.sample("heap_bytes", fmt.Sprintf("worker=\"%d\"", i), float64(heap))
+	}
+	return m.err
+}
+
+// metrics writes Prometheus text, keeping the first error
+type metrics struct {
+	w      io.Writer
+	prefix string
+	err    error
+}
+
+func (m *metrics) header(name, kind, help string) {
+	m.printf("# HELP %s_%s %s\n# TYPE %s_%s %s\n", m.prefix, name, help, m.prefix, name, kind)
+}
+
+func (m *metrics) sample(name, labels string, v float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	m.printf("%s_%s%s %g\n", m.prefix, name, labels, v)
+}
+
+func (m *metrics) metric(name, kind, help string, v float64) {
+	m.header(name, kind, help)
+	m.sample(name, "", v)
+}
+
+func (m *metrics) summary(name, help, labels string, d DurationStats) {
+	m.header(name, "summary", help)
+	m.quantiles(name, labels, d)
+}
+
+func (m *metrics) quantiles(name, labels string, d DurationStats) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	m.sample(name, labels+sep+`quantile="0.5"`, d.P50.Seconds())
+	m.sample(name, labels+sep+`quantile="0.99"`, d.P99.Seconds())
+	m.sample(name+"_sum", labels, d.Total.Seconds())
+	m.sample(name+"_count", labels, float64(d.Count))
+}
+
+func (m *metrics) printf(format string, args ...interface{}) {
+	if m.err != nil {
+		return
+	}
+	_, m.err = fmt.Fprintf(m.w, format, args...)
+}
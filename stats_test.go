@@ -0,0 +1,74 @@
+package jsapi
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPoolStats(t *testing.T) {
+
+	p := NewPool(2)
+	defer p.Destroy()
+
+	for i := 0; i < 10; i++ {
+		if err := p.Exec(`var x = 1`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Exec(`throw new Error('boom')`); err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	st := p.Stats()
+	if st.Workers != 2 {
+		t.Fatalf("expected 2 workers but got %d", st.Workers)
+	}
+	if st.Executions != 11 {
+		t.Fatalf("expected 11 executions but got %d", st.Executions)
+	}
+	if st.Errors != 1 {
+		t.Fatalf("expected 1 error but got %d", st.Errors)
+	}
+	if st.ExecTime.P99 < st.ExecTime.P50 || st.ExecTime.Max <= 0 {
+		t.Fatalf("expected exec times to be recorded but got %+v", st.ExecTime)
+	}
+	if st.ExecTime.Total < st.ExecTime.Max {
+		t.Fatalf("expected total exec time to include the longest call but got %+v", st.ExecTime)
+	}
+	if st.WaitTime.Count != 11 {
+		t.Fatalf("expected 11 wait times but got %d", st.WaitTime.Count)
+	}
+	if len(st.Heap) != 2 || st.Heap[0] <= 0 {
+		t.Fatalf("expected heap sizes for 2 workers but got %v", st.Heap)
+	}
+
+}
+
+func TestPoolWritePrometheus(t *testing.T) {
+
+	p := NewPool(2)
+	defer p.Destroy()
+
+	if err := p.Exec(`1`); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := p.WritePrometheus(&buf, "test_pool"); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, exp := range []string{
+		"# TYPE test_pool_workers gauge\ntest_pool_workers 2\n",
+		"test_pool_executions_total 1\n",
+		`test_pool_exec_seconds{quantile="0.99"}`,
+		`test_pool_wait_seconds_count{priority="normal"} 1`,
+		`test_pool_heap_bytes{worker="1"}`,
+	} {
+		if !strings.Contains(out, exp) {
+			t.Fatalf("expected output to contain %q but got:\n%s", exp, out)
+		}
+	}
+
+}